@@ -0,0 +1,124 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// artifactsCmd represents the artifacts command
+var artifactsCmd = &cobra.Command{
+	Use:   "artifacts",
+	Short: "Lists and downloads the artifacts of the stages.",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		rootCmd.Help()
+	},
+}
+
+// An artifact of a stage, as returned by the controller
+type artifact struct {
+	Name        string
+	Size        int64
+	ContentType string
+	Sha256      string
+	Archive     bool
+	CreatedAt   *time.Time
+	ExpiresAt   *time.Time
+}
+
+// Returns the URL of the artifacts of a stage, or of one of them when a name is given
+func artifactsURL(id string, stage string, name string) string {
+	u := "http://localhost:8081/pipelines/" + url.PathEscape(id) + "/stages/" + url.PathEscape(stage) + "/artifacts"
+	if name == "" {
+		return u
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+
+	return u + "/" + strings.Join(segments, "/")
+}
+
+// Gets the list of the artifacts of a stage from the controller
+func listArtifacts(id string, stage string) []artifact {
+	resp, err := http.Get(artifactsURL(id, stage, ""))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("request failed with status %d, %s", resp.StatusCode, body)
+	}
+
+	var artifacts []artifact
+	err = json.Unmarshal(body, &artifacts)
+	if err != nil {
+		log.Fatalf("could not parse the list of artifacts, %v", err)
+	}
+
+	return artifacts
+}
+
+// Reads the pipeline id and the stage name flags, which both are required
+func artifactsFlags(cmd *cobra.Command) (string, string) {
+	id, _ := cmd.Flags().GetString("id")
+	stage, _ := cmd.Flags().GetString("stage")
+	if id == "" || stage == "" {
+		log.Fatal("the id of the pipeline and the name of the stage are required\n")
+	}
+
+	return id, stage
+}
+
+// Formats a size in bytes for humans
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	rootCmd.AddCommand(artifactsCmd)
+	artifactsCmd.PersistentFlags().StringP("id", "i", "", "The id of the pipeline.")
+	artifactsCmd.PersistentFlags().StringP("stage", "s", "", "The name of the stage.")
+}
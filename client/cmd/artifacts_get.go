@@ -0,0 +1,110 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// artifactsGetCmd represents the artifacts get command
+var artifactsGetCmd = &cobra.Command{
+	Use:   "get [path...]",
+	Short: "Downloads the artifacts of a stage to a local directory, all of them when no path is given.",
+	Long:  `The directories are downloaded as tar archives named after them, e.g. "reports.tar".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		id, stage := artifactsFlags(cmd)
+		output, _ := cmd.Flags().GetString("output")
+
+		names := args
+		if len(names) == 0 {
+			for _, a := range listArtifacts(id, stage) {
+				names = append(names, a.Name)
+			}
+		}
+
+		for _, name := range names {
+			file, err := downloadArtifact(id, stage, name, output)
+			if err != nil {
+				log.Fatalf("could not download artifact %s, %v", name, err)
+			}
+			fmt.Println(file)
+		}
+	},
+}
+
+// Downloads an artifact of a stage into a directory, at the same path as in the stage,
+// and returns the path of the downloaded file
+func downloadArtifact(id string, stage string, name string, dir string) (string, error) {
+	resp, err := http.Get(artifactsURL(id, stage, name))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("request failed with status %d, %s", resp.StatusCode, body)
+	}
+
+	// The directories are stored as archives, whose file name the controller gives
+	name = path.Clean("/" + name)[1:]
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		name = path.Join(path.Dir(name), path.Base(params["filename"]))
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(f, io.TeeReader(resp.Body, hash))
+	if err != nil {
+		return "", err
+	}
+
+	if sum := resp.Header.Get("X-Artifact-Sha256"); sum != "" && sum != hex.EncodeToString(hash.Sum(nil)) {
+		os.Remove(file)
+		return "", fmt.Errorf("checksum mismatch, the download of %s is corrupted", file)
+	}
+
+	return file, f.Close()
+}
+
+func init() {
+	artifactsCmd.AddCommand(artifactsGetCmd)
+	artifactsGetCmd.Flags().StringP("output", "o", ".", "The directory the artifacts are downloaded to.")
+}
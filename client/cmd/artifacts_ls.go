@@ -0,0 +1,49 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// artifactsLsCmd represents the artifacts ls command
+var artifactsLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Lists the artifacts of a stage.",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		id, stage := artifactsFlags(cmd)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSIZE\tTYPE\tCREATED\tEXPIRES")
+		for _, a := range listArtifacts(id, stage) {
+			name := a.Name
+			if a.Archive {
+				name += "/"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, formatSize(a.Size), a.ContentType, formatTime(a.CreatedAt), formatTime(a.ExpiresAt))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	artifactsCmd.AddCommand(artifactsLsCmd)
+}
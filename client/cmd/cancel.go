@@ -0,0 +1,65 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "Cancels a running pipeline.",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		id, _ := cmd.Flags().GetString("id")
+		if id == "" {
+			log.Fatal("the id of the pipeline is required\n")
+		}
+
+		req, err := http.NewRequest(http.MethodDelete, "http://localhost:8081/pipelines/"+id, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if resp.StatusCode != http.StatusAccepted {
+			log.Fatalf("could not cancel pipeline %s, %s", id, body)
+		}
+
+		fmt.Printf("pipeline %s is being canceled\n", id)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+	cancelCmd.PersistentFlags().StringP("id", "i", "", "The id of the pipeline to be canceled.")
+}
@@ -2,10 +2,17 @@ package cmd
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
 )
 
 const (
@@ -34,3 +41,56 @@ func initConn() *sql.DB {
 	fmt.Println("Successfully connected to database!")
 	return db
 }
+
+// dbCmd represents the db command
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manages the schema of the CI database.",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		rootCmd.Help()
+	},
+}
+
+// A schema migration, as returned by the controller
+type migration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Prints the list of migrations returned by the controller in a response
+func printMigrations(resp *http.Response) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("request failed with status %d, %s", resp.StatusCode, body)
+	}
+
+	var migrations []migration
+	err = json.Unmarshal(body, &migrations)
+	if err != nil {
+		log.Fatalf("could not parse the list of migrations, %v", err)
+	}
+
+	writeMigrations(migrations)
+}
+
+// Prints a table of the migrations
+func writeMigrations(migrations []migration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, formatTime(m.AppliedAt))
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"controller/schema"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Applies the pending schema migrations and lists them.",
+	Long: `Applies the pending schema migrations directly to the database, under the same
+lock as the controller, then lists the migrations and when they were applied.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db := initConn()
+		defer db.Close()
+
+		applied, err := schema.Migrate(db)
+		if err != nil {
+			log.Fatalf("could not migrate the database, %v", err)
+		}
+		log.Printf("applied %d migrations\n", len(applied))
+
+		all, err := schema.Status(db)
+		if err != nil {
+			log.Fatalf("could not list the migrations, %v", err)
+		}
+
+		var migrations []migration
+		for _, m := range all {
+			migrations = append(migrations, migration{Version: m.Version, Name: m.Name, AppliedAt: m.AppliedAt})
+		}
+		writeMigrations(migrations)
+	},
+}
+
+func init() {
+	dbCmd.AddCommand(migrateCmd)
+}
@@ -22,17 +22,30 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// The fields of a pipeline record that are listed by the command
+type pipelineRecord struct {
+	Id         string
+	Status     string
+	Priority   string
+	CreatedAt  *time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Duration   string
+}
+
 // pipelinesCmd represents the pipelines command
 var pipelinesCmd = &cobra.Command{
 	Use:   "pipelines",
 	Short: "Lists the pipelines.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("pipelines called")
 		resp, err := http.Get("http://localhost:8081/pipelines/")
 		if err != nil {
 			log.Fatalln(err)
@@ -43,18 +56,51 @@ var pipelinesCmd = &cobra.Command{
 			log.Fatalln(err)
 		}
 
-		var indentedBody bytes.Buffer
-		err = json.Indent(&indentedBody, []byte(string(body)), "", "\t")
+		// The JSON output keeps all the fields of the records, for the scripts reading it
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "json":
+			var indentedBody bytes.Buffer
+			err = json.Indent(&indentedBody, body, "", "\t")
+			if err != nil {
+				log.Fatalf("could not indent body json, %v", err)
+			}
+
+			fmt.Printf("%s\n", &indentedBody)
+			return
+		case "table":
+		default:
+			log.Fatalf("unknown output format %s, must be table or json", output)
+		}
+
+		var records []pipelineRecord
+		err = json.Unmarshal(body, &records)
 		if err != nil {
-			log.Fatalf("could not indent body json, %v", err)
+			log.Fatalf("could not parse the list of pipelines, %v", err)
 		}
 
-		log.Printf("%s\n", &indentedBody)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tPRIORITY\tCREATED\tSTARTED\tFINISHED\tDURATION")
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Id, r.Status, r.Priority,
+				formatTime(r.CreatedAt), formatTime(r.StartedAt), formatTime(r.FinishedAt), r.Duration)
+		}
+		w.Flush()
 	},
 }
 
+// Formats an optional timestamp in the local time zone
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
 func init() {
 	lsCmd.AddCommand(pipelinesCmd)
+	pipelinesCmd.Flags().StringP("output", "o", "table", "The output format, table or json with all the fields of the pipelines.")
 
 	// Here you will define your flags and configuration settings.
 
@@ -17,12 +17,17 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"controller/runner"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
@@ -34,13 +39,63 @@ var runCmd = &cobra.Command{
 	Short: "Runs a pipeline based on a .yaml file given as parameter.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("run called")
 		f, _ := cmd.Flags().GetString("file")
-		runPipeline(f)
+		local, _ := cmd.Flags().GetBool("local")
+
+		rawParams, _ := cmd.Flags().GetStringArray("param")
+		params, err := parseParams(rawParams)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+
+		if local {
+			executor, _ := cmd.Flags().GetString("executor")
+			shellDir, _ := cmd.Flags().GetString("shell-dir")
+			verbose, _ := cmd.Flags().GetBool("verbose")
+			runLocalPipeline(f, params, executor, shellDir, verbose)
+			return
+		}
+
+		fmt.Println("run called")
+		priority, _ := cmd.Flags().GetString("priority")
+		runPipeline(f, params, priority)
 	},
 }
 
-func runPipeline(file string) {
+// Parses the key=value parameters of a run
+func parseParams(raw []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range raw {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid parameter %s, must be key=value", param)
+		}
+		params[key] = value
+	}
+
+	return params, nil
+}
+
+// Turns the values of the variables into strings, as YAML reads
+// values such as 8080 or true as numbers and booleans
+func stringifyVariables(holder map[string]interface{}) {
+	variables, ok := holder["variables"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for name, value := range variables {
+		if value == nil {
+			variables[name] = ""
+		} else {
+			variables[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Reads a pipeline file and turns the script of each stage into a shell command.
+// The parameters are added to the pipeline, overriding its variables
+func parsePipeline(file string, params map[string]string) map[string]interface{} {
 	data, err := ioutil.ReadFile(file)
 
 	if err != nil {
@@ -57,6 +112,11 @@ func runPipeline(file string) {
 		log.Fatal("no stages found in yaml file\n")
 	}
 
+	stringifyVariables(pipeline)
+	if len(params) > 0 {
+		pipeline["params"] = params
+	}
+
 	for _, stage := range stages {
 		script, ok := stage.(map[string]interface{})["script"].(string)
 		if !ok {
@@ -69,6 +129,18 @@ func runPipeline(file string) {
 		final := []string{"/bin/sh", "-c", joined}
 
 		stage.(map[string]interface{})["script"] = final
+		stringifyVariables(stage.(map[string]interface{}))
+	}
+
+	return pipeline
+}
+
+func runPipeline(file string, params map[string]string, priority string) {
+	pipeline := parsePipeline(file, params)
+
+	// The flag overrides the priority class set in the pipeline file
+	if priority != "" {
+		pipeline["priority"] = priority
 	}
 
 	body, err := json.Marshal(pipeline)
@@ -92,7 +164,49 @@ func runPipeline(file string) {
 	fmt.Printf("resp with body %s with status %d\n", respBody, resp.StatusCode)
 }
 
+// Runs a pipeline on this machine, without submitting it to the controller.
+// The process exits with a non-zero code when the pipeline does not pass
+func runLocalPipeline(file string, params map[string]string, executor string, shellDir string, verbose bool) {
+	body, err := json.Marshal(parsePipeline(file, params))
+	if err != nil {
+		panic(err)
+	}
+
+	var p runner.Pipeline
+	if err := json.Unmarshal(body, &p); err != nil {
+		log.Fatalf("invalid pipeline: %v", err)
+	}
+
+	// The scheduler logs are only useful when debugging the pipeline. The scheduler does not
+	// exit on the errors of the stages, they are printed with the logs of the failed attempts,
+	// and the errors of the run itself are printed below, whether the logs are shown or not
+	if !verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// Ctrl-C cancels the pipeline, so the containers are stopped and removed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	status, err := runner.Run(ctx, p, runner.Options{Executor: executor, ShellDir: shellDir, Out: os.Stdout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if status != runner.StatusSuccess && status != runner.StatusPassedWithWarnings {
+		os.Exit(1)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.PersistentFlags().StringP("file", "f", "pipeline.yaml", "pipeline file (default is pipeline.yaml)")
+	runCmd.Flags().String("priority", "", "priority class of the pipeline, low, normal or high (default is the pipeline priority, or normal), "+
+		"not checked by the controller, so keep high for the urgent pipelines")
+	runCmd.Flags().StringArray("param", nil, "key=value parameter overriding a variable declared in the pipeline, can be repeated")
+	runCmd.Flags().Bool("local", false, "run the pipeline on this machine instead of submitting it to the controller")
+	runCmd.Flags().String("executor", "", "executor of a local run, docker or shell (default is the pipeline executor, or docker)")
+	runCmd.Flags().String("shell-dir", "", "working directory of the shell executor in a local run (default is a temporary directory)")
+	runCmd.Flags().BoolP("verbose", "v", false, "print the scheduler logs of a local run")
 }
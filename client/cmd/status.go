@@ -0,0 +1,42 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Lists the schema migrations and when they were applied.",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		resp, err := http.Get("http://localhost:8081/migrations")
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		printMigrations(resp)
+	},
+}
+
+func init() {
+	dbCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Stores the artifacts of the stages, keyed by slash separated paths
+type ArtifactStore interface {
+	// Stores the content under a key and returns the location of the artifact
+	Put(ctx context.Context, key string, content io.Reader, contentType string) (string, error)
+
+	// Opens the content stored under a key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Deletes the content stored under a key, which is not an error when there is none
+	Delete(ctx context.Context, key string) error
+}
+
+// Configuration of an S3 compatible artifact storage, e.g. AWS S3 or MinIO
+type S3Config struct {
+	Bucket string
+
+	// Endpoint of the storage, e.g. "http://minio:9000", AWS S3 being used when empty
+	Endpoint string
+
+	// Addresses the buckets in the path instead of the host name, as MinIO expects
+	PathStyle bool
+
+	Region string
+
+	// Returns the access key, the secret key and the region of the storage. When nil,
+	// the credentials come from the environment (AWS_ACCESS_KEY_ID, ...) and the region from Region
+	Credentials func() (string, string, string, error)
+}
+
+// Artifact storage in an S3 bucket
+type S3ArtifactStore struct {
+	config S3Config
+
+	// Created on the first use, as the credentials may not be readable at startup,
+	// and again whenever the credentials they were created with change
+	mu       sync.Mutex
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	creds    s3Credentials
+}
+
+// Credentials returned by S3Config.Credentials
+type s3Credentials struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// Creates an artifact storage in the bucket of the given S3 compatible storage
+func NewS3ArtifactStore(config S3Config) *S3ArtifactStore {
+	return &S3ArtifactStore{config: config}
+}
+
+// Returns the client of the storage, creating it on the first successful call. The
+// credentials are read on every call, so that the client is created again once they
+// are rotated, e.g. in Vault, whose secrets are only cached for a while
+func (s *S3ArtifactStore) session() (*s3.S3, *s3manager.Uploader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var creds s3Credentials
+	if s.config.Credentials != nil {
+		accessKey, secretKey, region, err := s.config.Credentials()
+		if err != nil {
+			return nil, nil, err
+		}
+		creds = s3Credentials{accessKey: accessKey, secretKey: secretKey, region: region}
+	}
+
+	if s.client != nil && creds == s.creds {
+		return s.client, s.uploader, nil
+	}
+
+	awsConfig := &aws.Config{
+		S3ForcePathStyle: aws.Bool(s.config.PathStyle),
+	}
+
+	if s.config.Region != "" {
+		awsConfig.Region = aws.String(s.config.Region)
+	}
+
+	if s.config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(s.config.Endpoint)
+	}
+
+	if s.config.Credentials != nil {
+		awsConfig.Credentials = credentials.NewStaticCredentials(creds.accessKey, creds.secretKey, "")
+		if s.config.Region == "" {
+			awsConfig.Region = aws.String(creds.region)
+		}
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.client = s3.New(sess)
+	s.uploader = s3manager.NewUploaderWithClient(s.client)
+	s.creds = creds
+	return s.client, s.uploader, nil
+}
+
+func (s *S3ArtifactStore) Put(ctx context.Context, key string, content io.Reader, contentType string) (string, error) {
+	_, uploader, err := s.session()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.config.Bucket),
+		Key:         aws.String(key),
+		Body:        content,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result.Location, nil
+}
+
+func (s *S3ArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	client, _, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (s *S3ArtifactStore) Delete(ctx context.Context, key string) error {
+	client, _, err := s.session()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Artifact storage in a directory of the controller host, so that
+// the controller can run without any external storage
+type LocalArtifactStore struct {
+	dir string
+}
+
+// Creates an artifact storage that keeps the artifacts under dir
+func NewLocalArtifactStore(dir string) (*LocalArtifactStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalArtifactStore{dir: dir}, nil
+}
+
+// Returns the path of the file holding the artifact stored under a key
+func (s *LocalArtifactStore) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if p == s.dir || !insideDir(s.dir, p) {
+		return "", fmt.Errorf("invalid artifact key %s", key)
+	}
+
+	return p, nil
+}
+
+// The content type is not kept, as it is guessed again from the extension or the content
+func (s *LocalArtifactStore) Put(ctx context.Context, key string, content io.Reader, contentType string) (string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// The artifact is written aside first, so that it is never read half written
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+func (s *LocalArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (s *LocalArtifactStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -1,75 +1,558 @@
 package internal
 
 import (
+	"archive/tar"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+// When the artifacts of a stage are uploaded, after its container exited
+const (
+	ArtifactsOnSuccess = "on_success"
+	ArtifactsOnFailure = "on_failure"
+	ArtifactsAlways    = "always"
 )
 
-func CopyFromContainerToContainer(docker *client.Client, srcContainerID string, srcPath string, dstContainerID string, dstPath string) {
-	// Create a new context
-	ctx := context.Background()
+// The artifacts of a stage. It is either a list of paths or an object with the keys:
+// * "paths", the paths or glob patterns (e.g. "dist/**/*.jar") of the files and directories
+// * "exclude", the glob patterns of the files to leave out
+// * "when", "on_success" (the default), "on_failure" or "always"
+// * "expire_in", how long the uploaded artifacts are kept (e.g. "12h", "7d"), forever when empty
+type ArtifactsMeta struct {
+	Paths    []string `json:"paths"`
+	Exclude  []string `json:"exclude"`
+	When     string   `json:"when"`
+	ExpireIn string   `json:"expire_in"`
+}
+
+func (a *ArtifactsMeta) UnmarshalJSON(data []byte) error {
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err == nil {
+		*a = ArtifactsMeta{Paths: paths}
+		return nil
+	}
+
+	type artifactsMeta ArtifactsMeta
+	return json.Unmarshal(data, (*artifactsMeta)(a))
+}
+
+func (a ArtifactsMeta) validate() error {
+	for _, p := range append(append([]string(nil), a.Paths...), a.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s, %v", p, err)
+		}
+	}
+
+	for _, p := range a.Paths {
+		if prefix, literal := staticPrefix(p); literal && prefix == "." {
+			return fmt.Errorf("path %s must not be the whole working directory, e.g. reports or *.xml", p)
+		}
+	}
+
+	switch a.When {
+	case "", ArtifactsOnSuccess, ArtifactsOnFailure, ArtifactsAlways:
+	default:
+		return fmt.Errorf("invalid when %s, must be one of %s, %s or %s", a.When, ArtifactsOnSuccess, ArtifactsOnFailure, ArtifactsAlways)
+	}
+
+	if _, err := parseExpireIn(a.ExpireIn); err != nil {
+		return fmt.Errorf("invalid expire_in, %v", err)
+	}
+
+	return nil
+}
+
+// Tells if the artifacts are uploaded for a container that exited with the given code
+func (a ArtifactsMeta) upload(statusCode int64) bool {
+	switch a.When {
+	case ArtifactsAlways:
+		return true
+	case ArtifactsOnFailure:
+		return statusCode != 0
+	default:
+		return statusCode == 0
+	}
+}
+
+// Returns the time the artifacts uploaded now expire at, nil when they do not expire
+func (a ArtifactsMeta) expiresAt() *time.Time {
+	d, _ := parseExpireIn(a.ExpireIn)
+	if d == 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(d)
+	return &expiresAt
+}
+
+// Parses a duration that may also be given in days, e.g. "7d"
+func parseExpireIn(expireIn string) (time.Duration, error) {
+	if expireIn == "" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	if strings.HasSuffix(expireIn, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(expireIn, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", expireIn)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(expireIn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+
+	return d, nil
+}
+
+// Splits a pattern into the directory holding all its matches, which has no glob
+// characters, and tells if the pattern is a literal path without any glob character.
+// The directory is "." for the patterns matching files of the working directory, e.g. *.xml
+func staticPrefix(pattern string) (string, bool) {
+	segments := strings.Split(cleanArtifactPath(pattern), "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[\\") {
+			return path.Join(append([]string{"."}, segments[:i]...)...), false
+		}
+	}
+
+	return path.Join(append([]string{"."}, segments...)...), true
+}
+
+// Removes the first directory of a path in an archive
+func trimRoot(name string) string {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+
+	return ""
+}
+
+// Checks the directory the artifacts of a dependency are fetched into,
+// which must be inside the working directory of the stage
+func validateArtifactsPath(p string) error {
+	if path.IsAbs(p) || path.Clean(p) == ".." || strings.HasPrefix(path.Clean(p), "../") {
+		return fmt.Errorf("%s is outside of the working directory", p)
+	}
+
+	return nil
+}
+
+// Cleans a path of the working directory of a stage, without the leading "/" or "./"
+func cleanArtifactPath(p string) string {
+	return path.Clean("/" + p)[1:]
+}
+
+// Matches a path against a glob pattern, where "**" matches any number of directories
+func matchArtifact(pattern string, name string) bool {
+	return matchSegments(strings.Split(cleanArtifactPath(pattern), "/"), strings.Split(cleanArtifactPath(name), "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// Tells if a path matches one of the exclude patterns
+func excluded(exclude []string, name string) bool {
+	for _, pattern := range exclude {
+		if matchArtifact(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the files matching a path or a pattern from a container, as a tar archive
+// rooted at the base name of the directory part of the pattern, like the ones of CopyOut.
+// A literal path keeps the whole file or directory, while a pattern only keeps the files
+// that match. The excluded files are left out in both cases.
+func artifactArchive(executor Executor, containerId string, pattern string, exclude []string) (io.ReadCloser, error) {
+	prefix, literal := staticPrefix(pattern)
 
-	// Open a new reader for the file in the source container
-	reader, _, err := docker.CopyFromContainer(ctx, srcContainerID, srcPath)
+	reader, err := executor.CopyOut(context.Background(), containerId, prefix)
 	if err != nil {
-		log.Fatalf("could not copy files %s from container %s to host\n", srcPath, srcContainerID)
+		return nil, err
 	}
 
-	defer reader.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+
+		tr := tar.NewReader(reader)
+		tw := tar.NewWriter(pw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			// The archive of the working directory is rooted at its base name, which is
+			// left out so the entries are at the same paths as in the working directory
+			if prefix == "." {
+				hdr.Name = trimRoot(strings.TrimSuffix(hdr.Name, "/"))
+				if hdr.Name == "" {
+					continue
+				}
+				if hdr.Typeflag == tar.TypeLink {
+					hdr.Linkname = trimRoot(hdr.Linkname)
+				}
+			}
+
+			name := path.Join(path.Dir(prefix), hdr.Name)
+			if excluded(exclude, name) {
+				continue
+			}
+			if !literal && (hdr.Typeflag != tar.TypeReg || !matchArtifact(pattern, name)) {
+				continue
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
 
-	// Open a new writer for the file in the destination container
-	err = docker.CopyToContainer(ctx, dstContainerID, dstPath, reader, types.CopyToContainerOptions{})
+		pw.CloseWithError(tw.Close())
+	}()
+
+	return pr, nil
+}
+
+// Copies the artifacts of a stage from its container to the working directory of another one,
+// at the same paths as in the stage, under the dstPath directory
+func CopyFromContainerToContainer(executor Executor, srcContainerID string, artifacts ArtifactsMeta, dstContainerID string, dstPath string) {
+	for _, p := range artifacts.Paths {
+		reader, err := artifactArchive(executor, srcContainerID, p, artifacts.Exclude)
+		if err != nil {
+			log.Printf("could not copy artifact %s from container %s, %v\n", p, srcContainerID, err)
+			continue
+		}
+
+		prefix, _ := staticPrefix(p)
+		relocated := relocateArchive(reader, path.Join(cleanArtifactPath(dstPath), path.Dir(prefix)))
+
+		err = executor.CopyIn(context.Background(), dstContainerID, "./", relocated)
+		relocated.Close()
+		reader.Close()
+		if err != nil {
+			log.Printf("could not copy artifact %s from container %s to container %s, %v\n", p, srcContainerID, dstContainerID, err)
+		}
+	}
+}
+
+// An artifact of a stage, as stored in the artifact storage
+type Artifact struct {
+	// Path of the artifact in the stage, as given in the pipeline
+	Name string
+
+	Key      string
+	Location string
+
+	Size        int64
+	ContentType string
+	Sha256      string
+
+	// Set when the artifact is a directory, stored as a tar archive
+	Archive bool
+
+	// Permissions of the file, restored when it is passed to the dependent stages
+	Mode int64
+
+	// Time the artifact is deleted at, nil when it is kept forever
+	ExpiresAt *time.Time
+}
+
+// Returns the key of an artifact of a stage in the artifact storage
+func artifactKey(pipelineName string, stageName string, name string) string {
+	return pipelineName + "/" + stageName + "/artifacts/" + cleanArtifactPath(name)
+}
+
+// Stores the artifacts matching a path or a pattern of a container in the artifact storage.
+// The files are stored as is under their own key, and the directories given by a literal
+// path as a tar archive named after them
+func UploadArtifactsFromContainer(executor Executor, store ArtifactStore, pipelineName string, stageName string, srcContainerID string, pattern string, artifacts ArtifactsMeta) ([]Artifact, error) {
+	reader, err := artifactArchive(executor, srcContainerID, pattern, artifacts.Exclude)
 	if err != nil {
-		log.Fatalf("could not copy files from container %s to container %s\n", srcContainerID, dstContainerID)
+		return nil, err
+	}
+	defer reader.Close()
+
+	prefix, _ := staticPrefix(pattern)
+	expiresAt := artifacts.expiresAt()
+
+	var uploaded []Artifact
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return uploaded, nil
+		}
+		if err != nil {
+			return uploaded, fmt.Errorf("could not read artifact %s, %v", pattern, err)
+		}
+
+		name := path.Join(path.Dir(prefix), hdr.Name)
+
+		artifact := Artifact{Name: name, Key: artifactKey(pipelineName, stageName, name), Mode: hdr.Mode, ExpiresAt: expiresAt}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = uploadArtifact(store, &artifact, tr)
+		case tar.TypeDir:
+			artifact.Key += ".tar"
+			artifact.Archive = true
+
+			// Closing the archive stops the goroutine writing it when the upload failed halfway
+			archive := retar(hdr, tr)
+			err = uploadArtifact(store, &artifact, archive)
+			archive.CloseWithError(err)
+		default:
+			return uploaded, fmt.Errorf("artifact %s is neither a file nor a directory", name)
+		}
+		if err != nil {
+			return uploaded, err
+		}
+		uploaded = append(uploaded, artifact)
+
+		// The archive of a directory holds all the remaining entries
+		if artifact.Archive {
+			return uploaded, nil
+		}
 	}
 }
 
-func UploadArtifactFromContainer(docker *client.Client, pipelineName string, stageName string, srcContainerID string, srcPath string) string {
-	// Set the S3 bucket and destination path
-	bucket := "big-data-artifacts"
-	dstPath := pipelineName + "/" + stageName + "/artifacts/"
+// Downloads artifacts from the artifact storage into the working directory of a container,
+// at the same paths as in the stage that uploaded them, under the dstPath directory.
+// Unlike CopyFromContainerToContainer, the container of that stage is not needed anymore
+func DownloadArtifactsToContainer(ctx context.Context, executor Executor, store ArtifactStore, artifacts []Artifact, dstContainerID string, dstPath string) error {
+	if len(artifacts) == 0 {
+		return nil
+	}
+
+	dir := cleanArtifactPath(dstPath)
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		for _, artifact := range artifacts {
+			if err := writeArtifact(ctx, store, tw, artifact, dir); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
 
-	accessKey, secretKey, region := GetAWSCreds()
+		pw.CloseWithError(tw.Close())
+	}()
 
-	// Create a new AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
+	err := executor.CopyIn(ctx, dstContainerID, "./", pr)
+	pr.Close()
+	return err
+}
+
+// Writes an artifact read from the artifact storage to a tar archive, under dir
+func writeArtifact(ctx context.Context, store ArtifactStore, tw *tar.Writer, artifact Artifact, dir string) error {
+	content, err := store.Get(ctx, artifact.Key)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("could not read artifact %s, %v", artifact.Name, err)
+	}
+	defer content.Close()
+
+	name := path.Join(dir, artifact.Name)
+
+	// The archive of a directory is rooted at the base name of the directory
+	if artifact.Archive {
+		err = copyArchive(tw, tar.NewReader(content), path.Dir(name))
+		if err != nil {
+			return fmt.Errorf("could not read artifact %s, %v", artifact.Name, err)
+		}
+		return nil
 	}
 
-	// Create a new S3 manager
-	manager := s3manager.NewUploader(sess)
+	mode := artifact.Mode
+	if mode == 0 {
+		mode = 0644
+	}
 
-	// Open a new reader for the file in the container
-	reader, _, err := docker.CopyFromContainer(context.Background(), srcContainerID, srcPath)
+	err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: mode, Size: artifact.Size, ModTime: time.Now()})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer reader.Close()
 
-	// Create an S3 upload input
-	input := &s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(dstPath),
-		Body:   reader,
+	// The header already holds the size, so the content is checked against the
+	// size and the hash of the upload rather than failing with a "write too long"
+	hash := sha256.New()
+	n, err := io.Copy(tw, io.TeeReader(io.LimitReader(content, artifact.Size), hash))
+	if err != nil {
+		return fmt.Errorf("could not read artifact %s, %v", artifact.Name, err)
+	}
+	if extra, _ := io.ReadFull(content, make([]byte, 1)); n != artifact.Size || extra > 0 {
+		return fmt.Errorf("artifact %s does not have the size of %d bytes it was uploaded with", artifact.Name, artifact.Size)
+	}
+	if artifact.Sha256 != "" && hex.EncodeToString(hash.Sum(nil)) != artifact.Sha256 {
+		return fmt.Errorf("artifact %s does not have the sha256 it was uploaded with", artifact.Name)
+	}
+
+	return nil
+}
+
+// Moves the entries of a tar archive under dir
+func relocateArchive(r io.Reader, dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := copyArchive(tw, tar.NewReader(r), dir); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(tw.Close())
+	}()
+
+	return pr
+}
+
+// Copies the entries of a tar archive to another one, under dir
+func copyArchive(tw *tar.Writer, tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = path.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(dir, hdr.Linkname)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Stores the content of an artifact, setting its location, content type, size and hash
+func uploadArtifact(store ArtifactStore, artifact *Artifact, content io.Reader) error {
+	// The content type is guessed from the extension, or else from the first bytes
+	br := bufio.NewReader(content)
+	artifact.ContentType = mime.TypeByExtension(path.Ext(artifact.Key))
+	if artifact.ContentType == "" {
+		head, _ := br.Peek(512)
+		artifact.ContentType = http.DetectContentType(head)
 	}
 
-	// Upload the file to S3
-	result, err := manager.Upload(input)
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	var err error
+	artifact.Location, err = store.Put(context.Background(), artifact.Key, io.TeeReader(br, io.MultiWriter(hash, counter)), artifact.ContentType)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	return result.Location
+	artifact.Size = counter.n
+	artifact.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// Writes again, as a new tar archive, the entries of an archive whose first header was already read.
+// The caller must close the returned reader once done with it
+func retar(first *tar.Header, tr *tar.Reader) *io.PipeReader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+
+		hdr := first
+		for {
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			var err error
+			hdr, err = tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		pw.CloseWithError(tw.Close())
+	}()
+
+	return pr
+}
+
+// Counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
@@ -0,0 +1,103 @@
+package internal
+
+import "testing"
+
+func TestStaticPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		prefix  string
+		literal bool
+	}{
+		{"reports/*.xml", "reports", false},
+		{"dist/**/*.jar", "dist", false},
+		{"build/out/a?.txt", "build/out", false},
+		{"a/[ab]/c", "a", false},
+		{"*.xml", ".", false},
+		{"**/*.xml", ".", false},
+		{"reports", "reports", true},
+		{"./reports/junit.xml", "reports/junit.xml", true},
+		{"/reports/../dist/*.jar", "dist", false},
+	}
+
+	for _, tt := range tests {
+		prefix, literal := staticPrefix(tt.pattern)
+		if prefix != tt.prefix || literal != tt.literal {
+			t.Errorf("staticPrefix(%q) = %q, %v, want %q, %v", tt.pattern, prefix, literal, tt.prefix, tt.literal)
+		}
+	}
+}
+
+func TestMatchArtifact(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"reports/*.xml", "reports/junit.xml", true},
+		{"reports/*.xml", "reports/unit/junit.xml", false},
+		{"reports/*.xml", "reports/junit.json", false},
+		{"dist/**/*.jar", "dist/app.jar", true},
+		{"dist/**/*.jar", "dist/lib/x/app.jar", true},
+		{"dist/**/*.jar", "build/app.jar", false},
+		{"dist/**", "dist/lib/app.jar", true},
+		{"**/*.xml", "junit.xml", true},
+		{"**/*.xml", "a/b/junit.xml", true},
+		{"*.xml", "a/junit.xml", false},
+		{"./reports/*.xml", "reports/junit.xml", true},
+		{"reports/junit-?.xml", "reports/junit-1.xml", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchArtifact(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchArtifact(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	exclude := []string{"**/*-sources.jar", "dist/tmp/**"}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"dist/app.jar", false},
+		{"dist/app-sources.jar", true},
+		{"dist/lib/app-sources.jar", true},
+		{"dist/tmp/app.jar", true},
+		{"dist/tmp", true},
+		{"tmp/app.jar", false},
+	}
+
+	for _, tt := range tests {
+		if got := excluded(exclude, tt.name); got != tt.want {
+			t.Errorf("excluded(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if excluded(nil, "dist/app.jar") {
+		t.Error("excluded() without patterns = true, want false")
+	}
+}
+
+func TestArtifactsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    ArtifactsMeta
+		wantErr bool
+	}{
+		{"patterns", ArtifactsMeta{Paths: []string{"dist/**/*.jar", "*.xml"}, Exclude: []string{"**/*-sources.jar"}}, false},
+		{"when and expiry", ArtifactsMeta{Paths: []string{"reports"}, When: ArtifactsAlways, ExpireIn: "7d"}, false},
+		{"whole working directory", ArtifactsMeta{Paths: []string{"./"}}, true},
+		{"malformed pattern", ArtifactsMeta{Paths: []string{"reports/[.xml"}}, true},
+		{"malformed exclude", ArtifactsMeta{Paths: []string{"dist"}, Exclude: []string{"[a"}}, true},
+		{"unknown when", ArtifactsMeta{Paths: []string{"dist"}, When: "sometimes"}, true},
+		{"invalid expiry", ArtifactsMeta{Paths: []string{"dist"}, ExpireIn: "-1h"}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.meta.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
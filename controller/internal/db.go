@@ -1,9 +1,16 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
+	"embed"
 	"fmt"
 	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -16,6 +23,25 @@ const (
 	dbname   = "big-data-ci"
 )
 
+// Arbitrary key of the advisory lock held while migrating, so that
+// two controllers starting at the same time do not migrate concurrently
+const migrationLockKey = 7541203
+
+// The schema migrations, applied in the order of their version.
+// Each file is named <version>_<name>.sql, e.g. 0001_init.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// A schema migration and the time it was applied at, if it was applied
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+
+	statements string
+}
+
 func InitDBConn() *sql.DB {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
@@ -34,3 +60,174 @@ func InitDBConn() *sql.DB {
 	fmt.Println("Successfully connected to database!")
 	return db
 }
+
+// Reads the embedded migrations, sorted by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, e := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", e.Name())
+		}
+
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version, %v", e.Name(), err)
+		}
+
+		statements, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: v, Name: name, statements: string(statements)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Creates the table that tracks the applied migrations
+func createMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255),
+		applied_at TIMESTAMPTZ DEFAULT NOW()
+	)`)
+
+	return err
+}
+
+// Gets the applied migrations, keyed by version
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Lists all the embedded migrations with the time they were applied at
+func MigrationStatus(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range migrations {
+		if t, ok := applied[m.Version]; ok {
+			migrations[i].AppliedAt = &t
+		}
+	}
+
+	return migrations, nil
+}
+
+// Applies the pending migrations, each one in its own transaction,
+// and returns the migrations that were applied
+func Migrate(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+
+	// The advisory lock belongs to the database session,
+	// so all the statements run on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		log.Printf("applying migration %04d_%s\n", m.Version, m.Name)
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return done, err
+		}
+
+		if _, err := tx.ExecContext(ctx, m.statements); err != nil {
+			tx.Rollback()
+			return done, fmt.Errorf("migration %04d_%s failed, %v", m.Version, m.Name, err)
+		}
+
+		var appliedAt time.Time
+		err = tx.QueryRowContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2) RETURNING applied_at",
+			m.Version, m.Name).Scan(&appliedAt)
+		if err != nil {
+			tx.Rollback()
+			return done, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return done, err
+		}
+
+		m.AppliedAt = &appliedAt
+		done = append(done, m)
+	}
+
+	return done, nil
+}
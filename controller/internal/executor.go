@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"io"
+)
+
+// Labels set on the stage containers, so that they can be found
+// again when the controller restarts
+const (
+	LabelPipeline = "big-data-ci.pipeline"
+	LabelStage    = "big-data-ci.stage"
+	LabelAttempt  = "big-data-ci.attempt"
+	LabelUser     = "big-data-ci.user"
+
+	// The controller that created the container, so that the controllers
+	// sharing a Docker daemon only remove their own containers
+	LabelInstance = "big-data-ci.instance"
+)
+
+// Pull policies of the stage images
+const (
+	// Pulls the image before every stage, to get the latest version of its tag
+	PullAlways = "always"
+
+	// Pulls the image only when it is not present locally, the default
+	PullIfNotPresent = "if-not-present"
+
+	// Never pulls the image, the stage failing when it is not present locally
+	PullNever = "never"
+)
+
+// Describes the container of a stage attempt
+type ContainerSpec struct {
+	Name   string
+	Image  string
+	Cmd    []string
+	Labels map[string]string
+
+	// Environment variables, as KEY=value pairs
+	Env []string
+
+	// Secrets written to files before the container starts, keyed by name. The
+	// executor sets the environment variable of each one to the path of its file
+	SecretFiles map[string][]byte
+}
+
+// A container found by its labels
+type ContainerInfo struct {
+	Id     string
+	Labels map[string]string
+
+	// False when the container was created but never started
+	Started bool
+}
+
+// Runs the stage containers. The scheduler only goes through this interface,
+// so the DAG scheduling does not depend on the Docker daemon.
+// The lifecycle of a stage attempt is Create, CopyIn, Start, Wait, Logs, CopyOut and Remove
+type Executor interface {
+	// Makes the image available for new containers, e.g. by pulling it,
+	// following the pull policy of the stage
+	PrepareImage(ctx context.Context, image string, pullPolicy string) error
+
+	// Creates a container without starting it and returns its id
+	Create(ctx context.Context, spec ContainerSpec) (string, error)
+
+	// Extracts a tar archive at a path inside the container,
+	// the relative paths being relative to its working directory
+	CopyIn(ctx context.Context, id string, dstPath string, content io.Reader) error
+
+	Start(ctx context.Context, id string) error
+
+	// Blocks until the container exits and returns its exit code.
+	// Returns the context error when ctx is done before the container exits
+	Wait(ctx context.Context, id string) (int64, error)
+
+	// Stops the container gracefully
+	Stop(ctx context.Context, id string) error
+
+	// Stops the container right away
+	Kill(ctx context.Context, id string) error
+
+	// Returns the stdout and stderr written by the container so far
+	Logs(ctx context.Context, id string) ([]byte, error)
+
+	// Returns a tar archive of a path inside the container,
+	// the relative paths being relative to its working directory
+	CopyOut(ctx context.Context, id string, srcPath string) (io.ReadCloser, error)
+
+	// Removes the container, stopping it first if it is still running
+	Remove(ctx context.Context, id string) error
+
+	// Lists the containers, running or not, that have all the given labels
+	List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error)
+}
+
+// Implemented by the executors that can stream the logs of a container while it runs
+type LogFollower interface {
+	// Writes the stdout and stderr of the container to w as they are written,
+	// until the container exits or ctx is done
+	FollowLogs(ctx context.Context, id string, w io.Writer) error
+}
+
+// Tells if a container has all the given labels
+func hasLabels(containerLabels map[string]string, labels map[string]string) bool {
+	for k, v := range labels {
+		if containerLabels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Working directory of the stages whose image has none, so that the artifact
+// patterns of the working directory, e.g. *.xml, do not match the whole filesystem
+const dockerWorkDir = "/workspace"
+
+// Executor that runs the stages in containers of the local Docker daemon
+type DockerExecutor struct {
+	docker *client.Client
+
+	// Credentials of the private registries, the images being pulled anonymously when nil
+	auth RegistryAuth
+}
+
+// Creates a Docker executor with a client configured from the environment
+// (DOCKER_HOST, DOCKER_API_VERSION, ...)
+func NewDockerExecutor() (*DockerExecutor, error) {
+	docker, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DockerExecutor{docker: docker}, nil
+}
+
+// Pulls the images of the private registries with the given credentials
+func (e *DockerExecutor) SetRegistryAuth(auth RegistryAuth) {
+	e.auth = auth
+}
+
+func (e *DockerExecutor) PrepareImage(ctx context.Context, image string, pullPolicy string) error {
+	named, err := parseImage(image)
+	if err != nil {
+		return err
+	}
+
+	if pullPolicy != PullAlways {
+		_, _, err := e.docker.ImageInspectWithRaw(ctx, named.String())
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+
+		if pullPolicy == PullNever {
+			return fmt.Errorf("image %s is not present and the pull policy is %s", image, PullNever)
+		}
+	}
+
+	options := types.ImagePullOptions{}
+	if e.auth != nil {
+		registry := reference.Domain(named)
+
+		creds, ok, err := e.auth.Credentials(registry)
+		if err != nil {
+			return fmt.Errorf("could not get the credentials of registry %s, %v", registry, err)
+		}
+
+		if ok {
+			options.RegistryAuth, err = encodeRegistryAuth(registry, creds)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	reader, err := e.docker.ImagePull(ctx, named.String(), options)
+	if err != nil {
+		return err
+	}
+
+	// The pull progress goes with the logs, so it is silenced along with them
+	defer reader.Close()
+	_, err = io.Copy(log.Writer(), reader)
+	return err
+}
+
+func (e *DockerExecutor) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	env := spec.Env
+	for name := range spec.SecretFiles {
+		env = append(env, name+"="+path.Join(secretsDir, name))
+	}
+
+	image, _, err := e.docker.ImageInspectWithRaw(ctx, spec.Image)
+	if err != nil {
+		return "", err
+	}
+
+	workDir := ""
+	if image.Config == nil || image.Config.WorkingDir == "" || image.Config.WorkingDir == "/" {
+		workDir = dockerWorkDir
+	}
+
+	c, err := e.docker.ContainerCreate(ctx, &container.Config{
+		Image:      spec.Image,
+		Cmd:        spec.Cmd,
+		Env:        env,
+		WorkingDir: workDir,
+		Tty:        false,
+		Labels:     spec.Labels,
+	}, nil, nil, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(spec.SecretFiles) > 0 {
+		archive, err := secretsArchive(spec.SecretFiles)
+		if err == nil {
+			err = e.docker.CopyToContainer(ctx, c.ID, "/", archive, types.CopyToContainerOptions{})
+		}
+		if err != nil {
+			e.Remove(context.Background(), c.ID)
+			return "", fmt.Errorf("could not write the secret files, %v", err)
+		}
+	}
+
+	return c.ID, nil
+}
+
+// Resolves a path of a container against its working directory, as the
+// Docker API resolves the relative paths against the root of the container
+func (e *DockerExecutor) workPath(ctx context.Context, id string, p string) (string, error) {
+	if path.IsAbs(p) {
+		return p, nil
+	}
+
+	c, err := e.docker.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	dir := "/"
+	if c.Config != nil && c.Config.WorkingDir != "" {
+		dir = c.Config.WorkingDir
+	}
+
+	return path.Join(dir, p), nil
+}
+
+func (e *DockerExecutor) CopyIn(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	dstPath, err := e.workPath(ctx, id, dstPath)
+	if err != nil {
+		return err
+	}
+
+	return e.docker.CopyToContainer(ctx, id, dstPath, content, types.CopyToContainerOptions{})
+}
+
+func (e *DockerExecutor) Start(ctx context.Context, id string) error {
+	return e.docker.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (e *DockerExecutor) Wait(ctx context.Context, id string) (int64, error) {
+	statusCh, errCh := e.docker.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return -1, err
+	case status := <-statusCh:
+		return status.StatusCode, nil
+	}
+}
+
+func (e *DockerExecutor) Stop(ctx context.Context, id string) error {
+	return e.docker.ContainerStop(ctx, id, nil)
+}
+
+func (e *DockerExecutor) Kill(ctx context.Context, id string) error {
+	return e.docker.ContainerKill(ctx, id, "SIGKILL")
+}
+
+func (e *DockerExecutor) Logs(ctx context.Context, id string) ([]byte, error) {
+	out, err := e.docker.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	return ioutil.ReadAll(out)
+}
+
+// The containers have no TTY, so their logs are multiplexed and demultiplexed here
+func (e *DockerExecutor) FollowLogs(ctx context.Context, id string, w io.Writer) error {
+	out, err := e.docker.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = stdcopy.StdCopy(w, w, out)
+	return err
+}
+
+func (e *DockerExecutor) CopyOut(ctx context.Context, id string, srcPath string) (io.ReadCloser, error) {
+	srcPath, err := e.workPath(ctx, id, srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, _, err := e.docker.CopyFromContainer(ctx, id, srcPath)
+	return reader, err
+}
+
+func (e *DockerExecutor) Remove(ctx context.Context, id string) error {
+	return e.docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+}
+
+func (e *DockerExecutor) List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	args := filters.NewArgs()
+	for k, v := range labels {
+		args.Add("label", k+"="+v)
+	}
+
+	containers, err := e.docker.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ContainerInfo
+	for _, c := range containers {
+		infos = append(infos, ContainerInfo{Id: c.ID, Labels: c.Labels, Started: c.State != "created"})
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+)
+
+// Outcome of a container run by the fake executor
+type FakeResult struct {
+	ExitCode int64
+	Logs     string
+
+	// How long the container runs before exiting
+	Duration time.Duration
+
+	// Files written by the container, keyed by path, which can be read with CopyOut
+	Files map[string]string
+}
+
+// Executor that keeps the containers in memory and runs nothing, so the
+// scheduling of a pipeline can be exercised without a Docker daemon
+type FakeExecutor struct {
+	// Gives the outcome of every created container.
+	// When nil, all containers exit right away with code 0
+	Run func(spec ContainerSpec) FakeResult
+
+	mu         sync.Mutex
+	nextId     int
+	containers map[string]*fakeContainer
+	started    []string
+}
+
+type fakeContainer struct {
+	spec     ContainerSpec
+	started  bool
+	result   FakeResult
+	files    map[string][]byte
+	exited   chan struct{}
+	exitCode int64
+}
+
+func NewFakeExecutor(run func(spec ContainerSpec) FakeResult) *FakeExecutor {
+	return &FakeExecutor{
+		Run:        run,
+		containers: make(map[string]*fakeContainer),
+	}
+}
+
+// Returns the names of the started containers, in the order they were started
+func (e *FakeExecutor) Started() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string(nil), e.started...)
+}
+
+// Returns the files copied into a container, keyed by path
+func (e *FakeExecutor) Files(id string) map[string][]byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	files := make(map[string][]byte)
+	if c, ok := e.containers[id]; ok {
+		for k, v := range c.files {
+			files[k] = v
+		}
+	}
+
+	return files
+}
+
+func (e *FakeExecutor) container(id string) (*fakeContainer, error) {
+	c, ok := e.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+
+	return c, nil
+}
+
+func (e *FakeExecutor) PrepareImage(ctx context.Context, image string, pullPolicy string) error {
+	return ctx.Err()
+}
+
+func (e *FakeExecutor) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	result := FakeResult{}
+	if e.Run != nil {
+		result = e.Run(spec)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, c := range e.containers {
+		if c.spec.Name == spec.Name {
+			return "", fmt.Errorf("container name %s is already in use", spec.Name)
+		}
+	}
+
+	e.nextId++
+	id := fmt.Sprintf("fake-%d", e.nextId)
+
+	files := make(map[string][]byte)
+	for k, v := range result.Files {
+		files[path.Clean(k)] = []byte(v)
+	}
+
+	e.containers[id] = &fakeContainer{
+		spec:   spec,
+		result: result,
+		files:  files,
+		exited: make(chan struct{}),
+	}
+
+	return id, nil
+}
+
+func (e *FakeExecutor) CopyIn(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		c.files[path.Join(dstPath, hdr.Name)] = data
+	}
+}
+
+func (e *FakeExecutor) Start(ctx context.Context, id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	e.started = append(e.started, c.spec.Name)
+	c.started = true
+
+	go func() {
+		time.Sleep(c.result.Duration)
+		e.exit(c, c.result.ExitCode)
+	}()
+
+	return nil
+}
+
+// Marks a container as exited, unless it already exited
+func (e *FakeExecutor) exit(c *fakeContainer, code int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	select {
+	case <-c.exited:
+	default:
+		c.exitCode = code
+		close(c.exited)
+	}
+}
+
+func (e *FakeExecutor) Wait(ctx context.Context, id string) (int64, error) {
+	e.mu.Lock()
+	c, err := e.container(id)
+	e.mu.Unlock()
+	if err != nil {
+		return -1, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case <-c.exited:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return c.exitCode, nil
+	}
+}
+
+func (e *FakeExecutor) Stop(ctx context.Context, id string) error {
+	e.mu.Lock()
+	c, err := e.container(id)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	e.exit(c, 143)
+	return nil
+}
+
+func (e *FakeExecutor) Kill(ctx context.Context, id string) error {
+	e.mu.Lock()
+	c, err := e.container(id)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	e.exit(c, 137)
+	return nil
+}
+
+func (e *FakeExecutor) Logs(ctx context.Context, id string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.container(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(c.result.Logs), nil
+}
+
+func (e *FakeExecutor) CopyOut(ctx context.Context, id string, srcPath string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.container(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := c.files[path.Clean(srcPath)]
+	if !ok {
+		return nil, fmt.Errorf("could not find the file %s in container %s", srcPath, id)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err = tw.WriteHeader(&tar.Header{Name: path.Base(srcPath), Mode: 0644, Size: int64(len(data))})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (e *FakeExecutor) Remove(ctx context.Context, id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.exited:
+	default:
+		c.exitCode = 137
+		close(c.exited)
+	}
+
+	delete(e.containers, id)
+	return nil
+}
+
+func (e *FakeExecutor) List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var infos []ContainerInfo
+	for id, c := range e.containers {
+		if hasLabels(c.spec.Labels, labels) {
+			infos = append(infos, ContainerInfo{Id: id, Labels: c.spec.Labels, Started: c.started})
+		}
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,497 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long Stop waits for a script to exit after SIGTERM before killing it, like Docker does
+const shellStopTimeout = 10 * time.Second
+
+// Executor that runs the stage scripts directly on the host, without containers.
+// Every stage attempt gets its own working directory under the base directory,
+// the image of the pipeline is ignored and the stdout and stderr are captured in a log file.
+// The processes are only known by the executor that started them, so they cannot be
+// found again once the controller restarts
+type ShellExecutor struct {
+	baseDir string
+
+	mu    sync.Mutex
+	procs map[string]*shellProcess
+}
+
+type shellProcess struct {
+	dir     string
+	logPath string
+	labels  map[string]string
+	cmd     *exec.Cmd
+	exited  chan struct{}
+
+	// Set once the process exited
+	exitCode int64
+	// Exit code of the signal sent by Stop or Kill, 0 when neither was called
+	stopCode int64
+}
+
+// Creates a shell executor that keeps the working directories under baseDir
+func NewShellExecutor(baseDir string) (*ShellExecutor, error) {
+	err := os.MkdirAll(baseDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShellExecutor{
+		baseDir: baseDir,
+		procs:   make(map[string]*shellProcess),
+	}, nil
+}
+
+func (e *ShellExecutor) process(id string) (*shellProcess, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, ok := e.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("no such stage process: %s", id)
+	}
+
+	return p, nil
+}
+
+// Resolves a path inside a working directory, both relative and absolute
+// paths being relative to the working directory
+func resolveInDir(dir string, p string) (string, error) {
+	resolved := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+	if !insideDir(dir, resolved) {
+		return "", fmt.Errorf("path %s is outside of the working directory", p)
+	}
+
+	return resolved, nil
+}
+
+// Checks that a path does not escape a directory
+func insideDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (e *ShellExecutor) PrepareImage(ctx context.Context, image string, pullPolicy string) error {
+	return ctx.Err()
+}
+
+func (e *ShellExecutor) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	if len(spec.Cmd) == 0 {
+		return "", errors.New("the stage has no script")
+	}
+
+	// The working directory must be a direct child of the base directory,
+	// which the names with separators or dot segments would escape
+	dir := filepath.Join(e.baseDir, spec.Name)
+	if filepath.Dir(dir) != filepath.Clean(e.baseDir) {
+		return "", fmt.Errorf("invalid stage name %s", spec.Name)
+	}
+
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(spec.Cmd[0], spec.Cmd[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(hostEnv(), spec.Env...)
+	setProcessGroup(cmd)
+
+	// The secret files are kept out of the working directory, so they do not end up in the artifacts
+	secretsDir := dir + ".secrets"
+	for name, content := range spec.SecretFiles {
+		err = writeFile(filepath.Join(secretsDir, name), bytes.NewReader(content), 0400)
+		if err != nil {
+			os.RemoveAll(secretsDir)
+			os.RemoveAll(dir)
+			return "", err
+		}
+		cmd.Env = append(cmd.Env, name+"="+filepath.Join(secretsDir, name))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.procs[spec.Name] = &shellProcess{
+		dir:     dir,
+		logPath: dir + ".log",
+		labels:  spec.Labels,
+		cmd:     cmd,
+		exited:  make(chan struct{}),
+	}
+
+	return spec.Name, nil
+}
+
+func (e *ShellExecutor) CopyIn(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	dst, err := resolveInDir(p.dir, dstPath)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if !insideDir(p.dir, target) {
+			return fmt.Errorf("archive entry %s is outside of the working directory", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFile(target, tr, os.FileMode(hdr.Mode).Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Writes a file, creating its parent directories
+func writeFile(target string, content io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, content)
+	return err
+}
+
+// Variables of the controller environment passed to the scripts. The other ones,
+// e.g. the Vault and AWS credentials of the controller, are kept from the scripts
+var hostEnvAllowlist = []string{"PATH", "HOME", "TMPDIR", "LANG"}
+
+// Returns the variables of the allowlist set in the controller environment
+func hostEnv() []string {
+	var env []string
+	for _, name := range hostEnvAllowlist {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return env
+}
+
+func (e *ShellExecutor) Start(ctx context.Context, id string) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	// The output goes straight to a file, so waiting for the script
+	// does not depend on the processes it left in the background
+	logFile, err := os.Create(p.logPath)
+	if err != nil {
+		return err
+	}
+
+	p.cmd.Stdout = logFile
+	p.cmd.Stderr = logFile
+
+	// The process is set by Start, while Stop, Kill and List may read it
+	e.mu.Lock()
+	err = p.cmd.Start()
+	e.mu.Unlock()
+	if err != nil {
+		logFile.Close()
+		return err
+	}
+
+	go func() {
+		p.cmd.Wait()
+		logFile.Close()
+
+		e.mu.Lock()
+		p.exitCode = int64(p.cmd.ProcessState.ExitCode())
+		if p.exitCode == -1 {
+			// The script was terminated by a signal, either the one of Stop or Kill,
+			// or another one such as a segfault or the OOM killer, which fails the stage
+			p.exitCode = p.stopCode
+			if p.exitCode == 0 {
+				p.exitCode = signalExitCode(p.cmd.ProcessState)
+			}
+		}
+		e.mu.Unlock()
+
+		close(p.exited)
+	}()
+
+	return nil
+}
+
+func (e *ShellExecutor) Wait(ctx context.Context, id string) (int64, error) {
+	p, err := e.process(id)
+	if err != nil {
+		return -1, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case <-p.exited:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return p.exitCode, nil
+	}
+}
+
+// Sends a signal to the script and the processes it started
+func (e *ShellExecutor) signal(id string, kill bool) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+
+	e.mu.Lock()
+	if p.cmd.Process == nil {
+		e.mu.Unlock()
+		return nil
+	}
+
+	p.stopCode = 143
+	if kill {
+		p.stopCode = 137
+	}
+	e.mu.Unlock()
+
+	return signalProcessGroup(p.cmd, kill)
+}
+
+// Sends SIGTERM to the script, and kills it when it is still running after shellStopTimeout
+func (e *ShellExecutor) Stop(ctx context.Context, id string) error {
+	err := e.signal(id, false)
+	if err != nil {
+		return err
+	}
+
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(shellStopTimeout):
+	case <-ctx.Done():
+	}
+
+	return e.signal(id, true)
+}
+
+func (e *ShellExecutor) Kill(ctx context.Context, id string) error {
+	return e.signal(id, true)
+}
+
+func (e *ShellExecutor) Logs(ctx context.Context, id string) ([]byte, error) {
+	p, err := e.process(id)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.ReadFile(p.logPath)
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+
+	return out, err
+}
+
+// How often the log file of a running script is read again for new output
+const shellLogPollInterval = 200 * time.Millisecond
+
+// Reads the log file as the script writes to it, until the script exited
+func (e *ShellExecutor) FollowLogs(ctx context.Context, id string, w io.Writer) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p.logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		// The output written before the script exited is copied once more after it exited
+		exited := false
+		select {
+		case <-p.exited:
+			exited = true
+		default:
+		}
+
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		if exited {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.exited:
+		case <-time.After(shellLogPollInterval):
+		}
+	}
+}
+
+func (e *ShellExecutor) CopyOut(ctx context.Context, id string, srcPath string) (io.ReadCloser, error) {
+	p, err := e.process(id)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := resolveInDir(p.dir, srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return nil, err
+	}
+
+	// The archive is rooted at the base name of the path, like the ones from Docker
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, src))
+	}()
+
+	return pr, nil
+}
+
+// Writes a tar archive of a file or a directory, with paths relative to its parent
+func writeTar(w io.Writer, src string) error {
+	tw := tar.NewWriter(w)
+	parent := filepath.Dir(src)
+
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(parent, file)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func (e *ShellExecutor) Remove(ctx context.Context, id string) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	started := p.cmd.Process != nil
+	e.mu.Unlock()
+
+	select {
+	case <-p.exited:
+	default:
+		if started {
+			e.Kill(ctx, id)
+			<-p.exited
+		}
+	}
+
+	e.mu.Lock()
+	delete(e.procs, id)
+	e.mu.Unlock()
+
+	os.Remove(p.logPath)
+	os.RemoveAll(p.dir + ".secrets")
+	return os.RemoveAll(p.dir)
+}
+
+func (e *ShellExecutor) List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var infos []ContainerInfo
+	for id, p := range e.procs {
+		if hasLabels(p.labels, labels) {
+			infos = append(infos, ContainerInfo{Id: id, Labels: p.labels, Started: p.cmd.Process != nil})
+		}
+	}
+
+	return infos, nil
+}
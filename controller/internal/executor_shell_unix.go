@@ -0,0 +1,34 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Runs the script in its own process group, so the processes
+// it starts can be signaled together with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// Returns the exit code of a process terminated by a signal, 128 plus the signal like the shells
+func signalExitCode(state *os.ProcessState) int64 {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 1
+	}
+
+	return 128 + int64(status.Signal())
+}
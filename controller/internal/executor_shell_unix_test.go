@@ -0,0 +1,81 @@
+//go:build !windows
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Runs a script with the shell executor and returns its exit code
+func runShell(t *testing.T, e *ShellExecutor, name string, script string, stop func(ctx context.Context, id string) error) int64 {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id, err := e.Create(ctx, ContainerSpec{Name: name, Cmd: []string{"/bin/sh", "-c", script}})
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	defer e.Remove(context.Background(), id)
+
+	if err := e.Start(ctx, id); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+
+	if stop != nil {
+		if err := stop(ctx, id); err != nil {
+			t.Fatalf("stopping the script = %v", err)
+		}
+	}
+
+	code, err := e.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+
+	return code
+}
+
+func TestShellExitCodes(t *testing.T) {
+	e, err := NewShellExecutor(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewShellExecutor() = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		stop   func(ctx context.Context, id string) error
+		want   int64
+	}{
+		{name: "success", script: "true", want: 0},
+		{name: "exit code", script: "exit 3", want: 3},
+		{name: "segfault", script: "kill -SEGV $$", want: 139},
+		{name: "killed by another process", script: "kill -KILL $$", want: 137},
+		{name: "stopped", script: "sleep 30", stop: e.Stop, want: 143},
+		{name: "killed", script: "sleep 30", stop: e.Kill, want: 137},
+	}
+
+	for i, tt := range tests {
+		if got := runShell(t, e, fmt.Sprintf("stage-%d", i), tt.script, tt.stop); got != tt.want {
+			t.Errorf("%s: exit code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShellCreateRejectsEscapingNames(t *testing.T) {
+	e, err := NewShellExecutor(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewShellExecutor() = %v", err)
+	}
+
+	for _, name := range []string{"..", "../stage", "p/../../stage", "."} {
+		if _, err := e.Create(context.Background(), ContainerSpec{Name: name, Cmd: []string{"true"}}); err == nil {
+			t.Errorf("Create(%q) = nil, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process groups cannot be signaled on Windows,
+// so only the script itself is stopped
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, kill bool) error {
+	return cmd.Process.Kill()
+}
+
+// Processes are not terminated by signals on Windows, so any such exit is a failure
+func signalExitCode(state *os.ProcessState) int64 {
+	return 1
+}
@@ -33,6 +33,11 @@ func NewGraph() *Graph {
 	}
 }
 
+// Adds a node that may not have any dependency relationship
+func (g *Graph) AddNode(node string) {
+	g.nodes[node] = struct{}{}
+}
+
 func (g *Graph) DependOn(child, parent string) error {
 	if child == parent {
 		return errors.New("self-referential dependencies not allowed")
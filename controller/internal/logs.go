@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+)
+
+// How long the logs of an exited container are still followed, for the output not read yet
+const logFollowTimeout = 5 * time.Second
+
+// Receives the lines of the logs of the stages while their containers run
+type LogSink func(pipelineId string, stage string, line string)
+
+// Streams the logs of a running container to the log sink, line by line and with the
+// secrets masked, when the executor can follow them. The returned function waits for
+// the rest of the logs once the container exited, and stops following them
+func (s *Scheduler) followLogs(pipeline Pipeline, stage string, id string, secrets map[string]string) func() {
+	follower, ok := s.executorFor(pipeline).(LogFollower)
+	if s.logSink == nil || !ok {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &logLineWriter{sink: func(line string) {
+		s.logSink(pipeline.Name, stage, maskSecrets(line, secrets))
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		err := follower.FollowLogs(ctx, id, w)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("could not follow the logs of container %s, %v\n", id, err)
+		}
+		w.flush()
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(logFollowTimeout):
+			cancel()
+			<-done
+		}
+		cancel()
+	}
+}
+
+// Splits the logs written to it into lines, without the control bytes
+type logLineWriter struct {
+	sink    func(line string)
+	partial []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		w.sink(string(ReplaceControlBytes(w.partial[:i])))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+// Sends the last line, when the logs do not end with a new line
+func (w *logLineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.sink(string(ReplaceControlBytes(w.partial)))
+		w.partial = nil
+	}
+}
@@ -1,10 +1,12 @@
-CREATE TABLE pipelines (
+-- Initial schema, as created by the former database/init.sql.
+-- The tables may already exist in databases created by that script.
+CREATE TABLE IF NOT EXISTS pipelines (
   id VARCHAR (255) PRIMARY KEY NOT NULL,
   user_id VARCHAR(255),
   dependencies TEXT[][]
 );
 
-CREATE TABLE stages (
+CREATE TABLE IF NOT EXISTS stages (
     id SERIAL PRIMARY KEY,
     pipeline_id VARCHAR(255) REFERENCES pipelines(id),
     name VARCHAR(255),
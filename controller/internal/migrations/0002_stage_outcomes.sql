@@ -0,0 +1,18 @@
+-- Statuses of canceled, timed out, allowed to fail and skipped stages,
+-- the overall pipeline status and the history of the stage attempts.
+ALTER TABLE stages DROP CONSTRAINT IF EXISTS stages_status_check;
+ALTER TABLE stages ADD CONSTRAINT stages_status_check
+    CHECK (status IN ('SUCCESS', 'PENDING', 'RUNNING', 'FAILED', 'CANCELED', 'TIMED_OUT', 'FAILED_ALLOWED', 'SKIPPED'));
+
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS attempts INTEGER DEFAULT 0;
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS status VARCHAR(32);
+
+CREATE TABLE IF NOT EXISTS stage_attempts (
+    id SERIAL PRIMARY KEY,
+    pipeline_id VARCHAR(255) REFERENCES pipelines(id),
+    stage_name VARCHAR(255),
+    attempt INTEGER,
+    exit_code INTEGER,
+    message VARCHAR(65535),
+    status VARCHAR(16)
+);
@@ -0,0 +1,8 @@
+-- Queued, started and finished timestamps of the pipelines and the stages.
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ;
+
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+-- Stages waiting for a container slot are queued before they run.
+ALTER TABLE stages DROP CONSTRAINT IF EXISTS stages_status_check;
+ALTER TABLE stages ADD CONSTRAINT stages_status_check
+    CHECK (status IN ('SUCCESS', 'QUEUED', 'PENDING', 'RUNNING', 'FAILED', 'CANCELED', 'TIMED_OUT', 'FAILED_ALLOWED', 'SKIPPED'));
@@ -0,0 +1,2 @@
+-- Priority class of the pipelines, used when queueing their stages.
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS priority VARCHAR(16) DEFAULT 'normal';
@@ -0,0 +1,4 @@
+-- Specification of the pipelines and containers of the stages,
+-- used to resume the pipelines when the controller restarts.
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS spec JSONB;
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS container_id VARCHAR(255);
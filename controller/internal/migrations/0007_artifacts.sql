@@ -0,0 +1,15 @@
+-- Metadata of every artifact uploaded by a stage, stored under its own key.
+CREATE TABLE IF NOT EXISTS artifacts (
+    id SERIAL PRIMARY KEY,
+    pipeline_id VARCHAR(255) REFERENCES pipelines(id),
+    stage_name VARCHAR(255),
+    name VARCHAR(1024),
+    key VARCHAR(2048),
+    location VARCHAR(4096),
+    size BIGINT,
+    content_type VARCHAR(255),
+    sha256 CHAR(64),
+    archive BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (pipeline_id, stage_name, name)
+);
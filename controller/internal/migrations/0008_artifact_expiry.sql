@@ -0,0 +1,3 @@
+-- Time the artifacts uploaded with an expire_in are deleted at.
+ALTER TABLE artifacts ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS artifacts_expires_at ON artifacts (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Permissions of the artifacts stored as files, restored when they are passed to the dependent stages.
+ALTER TABLE artifacts ADD COLUMN IF NOT EXISTS mode INTEGER;
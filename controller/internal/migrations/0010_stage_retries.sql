@@ -0,0 +1,4 @@
+-- Time the running attempt of a stage started at, and time the next attempt of a stage
+-- waiting to retry starts at, so that a restart keeps the timeout and the backoff of the stage.
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS attempt_started_at TIMESTAMPTZ;
+ALTER TABLE stages ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
@@ -0,0 +1,3 @@
+-- Number of times a pipeline was resumed after a restart of the controller,
+-- so that a pipeline that keeps stopping the controller is failed instead of resumed again.
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS resumes INTEGER NOT NULL DEFAULT 0;
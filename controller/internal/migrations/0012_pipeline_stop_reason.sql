@@ -0,0 +1,3 @@
+-- Status a pipeline is being stopped with, CANCELED or TIMED_OUT, stored before its running
+-- stages are stopped, so that a restart of the controller finishes it with the same status.
+ALTER TABLE pipelines ADD COLUMN IF NOT EXISTS stop_reason VARCHAR(16);
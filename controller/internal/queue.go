@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by Acquire when the pipeline of the stage was withdrawn from the queue
+var errSlotWithdrawn = errors.New("stage was withdrawn from the queue")
+
+// How long a stage waits before it is queued with the next higher priority
+const defaultQueueAging = 5 * time.Minute
+
+// A stage waiting in the queue for a container slot
+type slotRequest struct {
+	pipelineId string
+	userId     string
+	stage      string
+	priority   int
+	enqueued   time.Time
+
+	// Closed when the slot is handed over to the stage,
+	// or when err is set because the stage left the queue
+	ready chan struct{}
+	err   error
+}
+
+// Limits the number of stages that run at the same time across all the pipelines.
+// A free slot goes to the waiting stage with the highest priority, the priority of a
+// stage being raised for every aging interval it waited, up to the highest class,
+// so that the stages of low priority still run while others keep coming. Within a priority
+// the slots are shared fairly between the users: the stage of the user running the
+// fewest stages goes first, then the one of the user served the least recently,
+// and the oldest one when there is still a tie.
+// A user can also be limited to a number of running stages, even when slots are free
+type SlotQueue struct {
+	mu   sync.Mutex
+	free int
+
+	// Maximum number of running stages per user, 0 meaning no limit
+	maxPerUser int
+
+	// How long a stage waits before its priority is raised by one class
+	aging time.Duration
+
+	// Number of running stages, keyed by user
+	running map[string]int
+
+	// Sequence number of the last slot given to each user, used to take
+	// turns between the users when they are running as many stages
+	grants    uint64
+	lastGrant map[string]uint64
+
+	// Waiting stages, in the order they asked for a slot
+	waiting []*slotRequest
+}
+
+// Creates a queue with the given number of container slots
+func NewSlotQueue(slots int) *SlotQueue {
+	return &SlotQueue{
+		free:      slots,
+		aging:     defaultQueueAging,
+		running:   make(map[string]int),
+		lastGrant: make(map[string]uint64),
+	}
+}
+
+// Sets the maximum number of stages of a single user running at the same time, 0 meaning no limit
+func (q *SlotQueue) SetMaxPerUser(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxPerUser = n
+	q.dispatch()
+}
+
+// Waits for a free slot, which is given to the stages following the policy of the queue.
+// The stage leaves the queue when ctx is canceled, returning the context error
+func (q *SlotQueue) Acquire(ctx context.Context, pipelineId string, userId string, stage string, priority int) error {
+	r := &slotRequest{
+		pipelineId: pipelineId,
+		userId:     userId,
+		stage:      stage,
+		priority:   priority,
+		enqueued:   time.Now(),
+		ready:      make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	q.waiting = append(q.waiting, r)
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-r.ready:
+		return r.err
+
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		for i, w := range q.waiting {
+			if w == r {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				q.forget(userId)
+				return ctx.Err()
+			}
+		}
+
+		// The slot was handed over while the stage was being canceled
+		if r.err == nil {
+			q.release(userId)
+		}
+		return ctx.Err()
+	}
+}
+
+// Takes a slot for a stage whose container is already running, without waiting.
+// The stages may then use more slots than the queue has, until some finish
+func (q *SlotQueue) Reserve(userId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.free--
+	q.running[userId]++
+}
+
+// Gives the slot of a finished stage of the user to the next stage in the queue
+func (q *SlotQueue) Release(userId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.release(userId)
+}
+
+func (q *SlotQueue) release(userId string) {
+	q.free++
+	q.running[userId]--
+	if q.running[userId] <= 0 {
+		delete(q.running, userId)
+		q.forget(userId)
+	}
+
+	q.dispatch()
+}
+
+// Hands the free slots over to the waiting stages
+func (q *SlotQueue) dispatch() {
+	now := time.Now()
+	for q.free > 0 {
+		i := q.next(now)
+		if i < 0 {
+			return
+		}
+
+		r := q.waiting[i]
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+		q.free--
+		q.running[r.userId]++
+		q.grants++
+		q.lastGrant[r.userId] = q.grants
+		close(r.ready)
+	}
+}
+
+// Drops the turn of a user that is neither running nor waiting for a slot
+func (q *SlotQueue) forget(userId string) {
+	if q.running[userId] > 0 {
+		return
+	}
+
+	for _, w := range q.waiting {
+		if w.userId == userId {
+			return
+		}
+	}
+
+	delete(q.lastGrant, userId)
+}
+
+// Returns the index of the waiting stage that gets the next free slot,
+// or -1 when all the waiting stages belong to users that reached their limit
+func (q *SlotQueue) next(now time.Time) int {
+	next := -1
+	for i, r := range q.waiting {
+		if q.maxPerUser > 0 && q.running[r.userId] >= q.maxPerUser {
+			continue
+		}
+
+		if next < 0 || q.before(r, q.waiting[next], now) {
+			next = i
+		}
+	}
+
+	return next
+}
+
+// Returns the priority of a waiting stage, raised by the time it waited
+func (q *SlotQueue) priority(r *slotRequest, now time.Time) int {
+	if q.aging <= 0 || r.priority >= priorityRanks[PriorityHigh] {
+		return r.priority
+	}
+
+	priority := r.priority + int(now.Sub(r.enqueued)/q.aging)
+	if priority > priorityRanks[PriorityHigh] {
+		return priorityRanks[PriorityHigh]
+	}
+
+	return priority
+}
+
+// Tells if a waiting stage gets a slot before another one. As the stages
+// are waiting in arrival order, the oldest one goes first when neither is before
+func (q *SlotQueue) before(a *slotRequest, b *slotRequest, now time.Time) bool {
+	if pa, pb := q.priority(a, now), q.priority(b, now); pa != pb {
+		return pa > pb
+	}
+
+	if q.running[a.userId] != q.running[b.userId] {
+		return q.running[a.userId] < q.running[b.userId]
+	}
+
+	return q.lastGrant[a.userId] < q.lastGrant[b.userId]
+}
+
+// Removes the waiting stages of a pipeline from the queue,
+// their Acquire calls returning errSlotWithdrawn
+func (q *SlotQueue) Withdraw(pipelineId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var withdrawn []*slotRequest
+	waiting := q.waiting[:0]
+	for _, w := range q.waiting {
+		if w.pipelineId == pipelineId {
+			w.err = errSlotWithdrawn
+			close(w.ready)
+			withdrawn = append(withdrawn, w)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+
+	q.waiting = waiting
+	for _, w := range withdrawn {
+		q.forget(w.userId)
+	}
+}
+
+// Returns the position of a stage in the queue, starting from 1, or 0 when the stage
+// is not waiting for a slot. The position is an estimate given the running stages,
+// as the share of the users changes while their stages start and finish
+func (q *SlotQueue) Position(pipelineId string, stage string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	order := append([]*slotRequest(nil), q.waiting...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return q.before(order[i], order[j], now)
+	})
+
+	for i, w := range order {
+		if w.pipelineId == pipelineId && w.stage == stage {
+			return i + 1
+		}
+	}
+
+	return 0
+}
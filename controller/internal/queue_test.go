@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a stage of the user waiting in the queue since the given time
+func waitingStage(userId string, priority string, enqueued time.Time) *slotRequest {
+	return &slotRequest{
+		pipelineId: "p-" + userId,
+		userId:     userId,
+		stage:      "stage",
+		priority:   priorityRanks[priority],
+		enqueued:   enqueued,
+		ready:      make(chan struct{}),
+	}
+}
+
+func TestSlotQueueNext(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		maxPerUser int
+		running    map[string]int
+		lastGrant  map[string]uint64
+		waiting    []*slotRequest
+		want       int
+	}{
+		{
+			name:    "higher priority first",
+			waiting: []*slotRequest{waitingStage("a", PriorityLow, now), waitingStage("b", PriorityHigh, now)},
+			want:    1,
+		},
+		{
+			name:    "arrival order within a priority",
+			waiting: []*slotRequest{waitingStage("a", PriorityNormal, now), waitingStage("b", PriorityNormal, now)},
+			want:    0,
+		},
+		{
+			name:    "aged low priority ties with normal",
+			waiting: []*slotRequest{waitingStage("a", PriorityLow, now.Add(-6*time.Minute)), waitingStage("b", PriorityNormal, now)},
+			want:    0,
+		},
+		{
+			name:    "low priority not aged yet",
+			waiting: []*slotRequest{waitingStage("a", PriorityLow, now.Add(-4*time.Minute)), waitingStage("b", PriorityNormal, now)},
+			want:    1,
+		},
+		{
+			name:    "aging stops at high priority",
+			waiting: []*slotRequest{waitingStage("a", PriorityHigh, now), waitingStage("b", PriorityLow, now.Add(-time.Hour))},
+			want:    0,
+		},
+		{
+			name:    "user running the fewest stages first",
+			running: map[string]int{"a": 2, "b": 1},
+			waiting: []*slotRequest{waitingStage("a", PriorityNormal, now), waitingStage("b", PriorityNormal, now)},
+			want:    1,
+		},
+		{
+			name:      "user served the least recently first",
+			lastGrant: map[string]uint64{"a": 5, "b": 3},
+			waiting:   []*slotRequest{waitingStage("a", PriorityNormal, now), waitingStage("b", PriorityNormal, now)},
+			want:      1,
+		},
+		{
+			name:    "priority before fairness",
+			running: map[string]int{"a": 3},
+			waiting: []*slotRequest{waitingStage("b", PriorityLow, now), waitingStage("a", PriorityNormal, now)},
+			want:    1,
+		},
+		{
+			name:       "user at its limit skipped",
+			maxPerUser: 1,
+			running:    map[string]int{"a": 1},
+			waiting:    []*slotRequest{waitingStage("a", PriorityHigh, now), waitingStage("b", PriorityLow, now)},
+			want:       1,
+		},
+		{
+			name:       "all users at their limit",
+			maxPerUser: 1,
+			running:    map[string]int{"a": 1},
+			waiting:    []*slotRequest{waitingStage("a", PriorityNormal, now)},
+			want:       -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewSlotQueue(1)
+			q.maxPerUser = tt.maxPerUser
+			q.waiting = tt.waiting
+			for user, n := range tt.running {
+				q.running[user] = n
+			}
+			for user, grant := range tt.lastGrant {
+				q.lastGrant[user] = grant
+			}
+
+			if got := q.next(now); got != tt.want {
+				t.Errorf("next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotQueueTakesTurns(t *testing.T) {
+	q := NewSlotQueue(1)
+	q.Reserve("x")
+
+	// a queues two stages before b queues one, but b goes second as a got the last slot
+	granted := make(chan string, 3)
+	for _, r := range []struct{ user, stage string }{{"a", "s1"}, {"a", "s2"}, {"b", "s1"}} {
+		r := r
+		go func() {
+			if err := q.Acquire(context.Background(), "p-"+r.user, r.user, r.stage, priorityRanks[PriorityNormal]); err != nil {
+				t.Errorf("Acquire() = %v", err)
+			}
+			granted <- r.user
+		}()
+
+		for q.Position("p-"+r.user, r.stage) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var order []string
+	last := "x"
+	for i := 0; i < 3; i++ {
+		q.Release(last)
+		last = <-granted
+		order = append(order, last)
+	}
+
+	if strings.Join(order, ",") != "a,b,a" {
+		t.Errorf("slots given to %v, want a, b then a", order)
+	}
+}
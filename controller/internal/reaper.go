@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Removes, at every interval, the containers created by this controller that are
+// not needed anymore: the ones of the pipelines that finished longer than the
+// retention ago, and the ones of the pipelines that are not stored at all.
+// The expired artifacts are deleted as well. The reaper stops once ctx is done
+func (s *Scheduler) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			s.reap(ctx)
+			s.reapArtifacts(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) reap(ctx context.Context) {
+	for name, executor := range s.executors {
+		containers, err := executor.List(ctx, map[string]string{LabelInstance: s.instance})
+		if err != nil {
+			log.Printf("could not list the containers of the %s executor, %v\n", name, err)
+			continue
+		}
+
+		// Whether the containers of a pipeline can be removed, keyed by pipeline id
+		expired := make(map[string]bool)
+
+		for _, c := range containers {
+			pipelineId := c.Labels[LabelPipeline]
+
+			remove, ok := expired[pipelineId]
+			if !ok {
+				remove = s.expired(pipelineId)
+				expired[pipelineId] = remove
+			}
+
+			if !remove {
+				continue
+			}
+
+			log.Printf("removing container %s of pipeline %s\n", c.Id, pipelineId)
+			if err := executor.Remove(ctx, c.Id); err != nil {
+				log.Printf("could not remove container %s, %v\n", c.Id, err)
+			}
+		}
+	}
+}
+
+// Tells if the containers of a pipeline can be removed. The containers of
+// the unfinished pipelines are kept, even when they are not scheduled, as
+// they are resumed or failed when the controller starts
+func (s *Scheduler) expired(pipelineId string) bool {
+	if s.scheduled(pipelineId) {
+		return false
+	}
+
+	finishedAt, ok := s.store.FinishedAt(pipelineId)
+	if !ok {
+		return true
+	}
+
+	return finishedAt != nil && time.Since(*finishedAt) >= s.retention
+}
+
+// Deletes the artifacts whose expire_in elapsed from the artifact storage
+func (s *Scheduler) reapArtifacts(ctx context.Context) {
+	if s.artifacts == nil {
+		return
+	}
+
+	for _, key := range s.store.ExpiredArtifacts() {
+		log.Printf("deleting expired artifact %s\n", key)
+		if err := s.artifacts.Delete(ctx, key); err != nil {
+			log.Printf("could not delete artifact %s, %v\n", key, err)
+			continue
+		}
+
+		s.store.DeleteArtifact(key)
+	}
+}
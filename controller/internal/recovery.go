@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Logs of a stage whose container could not be found after a restart of the controller
+const lostContainerMessage = "the container of the stage was lost while the controller was stopped"
+
+// Logs of a stage whose pipeline was resumed too many times, e.g. because it keeps stopping the controller
+const tooManyResumesMessage = "the pipeline was resumed too many times after restarts of the controller"
+
+// Logs of a stage whose containers could not be listed after a restart of the controller
+const listContainersMessage = "the containers of the pipeline could not be listed after a restart of the controller"
+
+// How many times a pipeline is resumed after restarts of the controller before it is failed
+const maxResumes = 3
+
+// A pipeline that was queued or running when the controller stopped
+type RecoveredPipeline struct {
+	Pipeline  Pipeline
+	StartedAt *time.Time
+	Stages    []RecoveredStage
+
+	// Time the pipeline was submitted at, from which its timeout counts like in Submit
+	CreatedAt time.Time
+
+	// Status the pipeline was being stopped with, CANCELED or TIMED_OUT, empty when it was not stopped
+	StopReason string
+
+	// Number of times the pipeline was already resumed
+	Resumes int
+}
+
+// A stored stage of a pipeline that was queued or running when the controller stopped
+type RecoveredStage struct {
+	Name        string
+	Status      string
+	ContainerId string
+	Attempt     int
+
+	// Time the container of the current attempt started at, nil when it did not start
+	AttemptStartedAt *time.Time
+
+	// Set when the stage was waiting to retry, to the time its next attempt starts at
+	NextAttemptAt *time.Time
+}
+
+// A stage attempt whose container was created before the controller restarted,
+// or the next attempt of a stage that was waiting to retry, which has no container
+type resumedAttempt struct {
+	containerId string
+	attempt     int
+	started     bool
+
+	// Time the container started at, from which the stage timeout counts
+	startedAt *time.Time
+
+	// Time the next attempt of a stage waiting to retry starts at
+	retryAt *time.Time
+}
+
+// Resumes the pipelines that were queued or running when the controller stopped.
+// The finished stages keep their status, the containers of the running stages are
+// found again by their labels and waited for, and the stages whose container is
+// gone are failed. The scheduling of the pipelines then goes on as usual.
+// A pipeline already resumed maxResumes times is failed instead, so that a
+// pipeline that keeps stopping the controller does not stop it on every restart
+func (s *Scheduler) Recover() {
+	for _, r := range s.store.UnfinishedPipelines() {
+		if err := s.Validate(r.Pipeline); err != nil {
+			log.Printf("pipeline %s cannot be resumed, %v\n", r.Pipeline.Name, err)
+			s.failLost(r, lostContainerMessage)
+			continue
+		}
+
+		if r.Resumes >= maxResumes {
+			log.Printf("pipeline %s was already resumed %d times, failing it\n", r.Pipeline.Name, r.Resumes)
+			s.failLost(r, tooManyResumesMessage)
+			continue
+		}
+
+		log.Printf("resuming pipeline %s\n", r.Pipeline.Name)
+		s.store.ResumePipeline(r.Pipeline.Name)
+		go s.resume(r)
+	}
+}
+
+// Fails a pipeline that cannot be resumed, along with its unfinished stages
+func (s *Scheduler) failLost(r RecoveredPipeline, message string) {
+	for _, stage := range r.Stages {
+		if stage.Status == StatusQueued || stage.Status == StatusRunning {
+			out := StageOutput{Name: stage.Name, Message: message, Status: -1, Attempt: stage.Attempt}
+			s.store.FinishStage(r.Pipeline.Name, out, StatusFailed)
+		}
+	}
+
+	s.store.FinishPipeline(r.Pipeline.Name, StatusFailed)
+}
+
+// Derives the context of a resumed pipeline or attempt, whose timeout
+// counts from the time it was submitted or started in the first place
+func resumeContext(ctx context.Context, timeout string, startedAt *time.Time) (context.Context, context.CancelFunc) {
+	d, _ := parseTimeout(timeout)
+	if d == 0 || startedAt == nil {
+		return withTimeout(ctx, timeout)
+	}
+
+	return context.WithDeadline(ctx, startedAt.Add(d))
+}
+
+// Rebuilds the state of a pipeline from the store and the executor, then schedules it
+func (s *Scheduler) resume(r RecoveredPipeline) error {
+	p := r.Pipeline
+	ctx, cancel := resumeContext(context.Background(), p.Timeout, &r.CreatedAt)
+	if r.StopReason == StatusTimedOut {
+		// The deadline is exceeded already, so the pipeline times out again rather than being canceled
+		ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	}
+	defer s.track(p.Name, cancel)()
+
+	containers, err := s.executorFor(p).List(context.Background(), map[string]string{LabelPipeline: p.Name})
+	if err != nil {
+		log.Printf("could not list the containers of pipeline %s, %v\n", p.Name, err)
+		s.failLost(r, listContainersMessage)
+		return err
+	}
+
+	// The container of the latest attempt of every stage. The labels are used rather than
+	// the stored ids, as the controller may have stopped before storing the last ones
+	latest := make(map[string]resumedAttempt)
+	for _, c := range containers {
+		stage := c.Labels[LabelStage]
+		attempt, _ := strconv.Atoi(c.Labels[LabelAttempt])
+
+		if l, ok := latest[stage]; !ok || attempt > l.attempt {
+			latest[stage] = resumedAttempt{containerId: c.Id, attempt: attempt, started: c.Started}
+		}
+	}
+
+	g, _ := NewGraphFromStages(p.Stages)
+	deps := newDependencyCounter(p.Stages)
+	doneCh := make(chan StageOutput, len(p.Stages))
+	statuses := make(map[string]string)
+	states := make(map[string]StageState)
+	stageToContainerId := make(map[string]string)
+
+	for stage := range p.Stages {
+		states[stage] = NotRunning
+	}
+
+	// A stage that was waiting to retry runs its next attempt once its backoff elapsed,
+	// unless the container of that attempt was already created. The container of
+	// the failed attempt may be left when the controller stopped before removing it
+	retries := make(map[string]resumedAttempt)
+	for _, stage := range r.Stages {
+		l, ok := latest[stage.Name]
+		if stage.NextAttemptAt == nil || (ok && l.attempt > stage.Attempt) {
+			continue
+		}
+
+		if ok {
+			s.executorFor(p).Remove(context.Background(), l.containerId)
+			delete(latest, stage.Name)
+		}
+		retries[stage.Name] = resumedAttempt{attempt: stage.Attempt + 1, retryAt: stage.NextAttemptAt}
+	}
+
+	// A container that never started is created again by the stage
+	recreate := make(map[string]bool)
+
+	for stage, l := range latest {
+		if !l.started {
+			s.executorFor(p).Remove(context.Background(), l.containerId)
+			delete(latest, stage)
+			recreate[stage] = true
+			continue
+		}
+
+		stageToContainerId[stage] = l.containerId
+	}
+
+	ready := deps.ready()
+	var unfinished []RecoveredStage
+
+	for _, stage := range r.Stages {
+		if _, ok := p.Stages[stage.Name]; !ok {
+			continue
+		}
+
+		if stage.Status == StatusQueued || stage.Status == StatusRunning {
+			if l, ok := latest[stage.Name]; ok && l.attempt == stage.Attempt {
+				l.startedAt = stage.AttemptStartedAt
+				latest[stage.Name] = l
+			}
+
+			states[stage.Name] = Running
+			unfinished = append(unfinished, stage)
+			continue
+		}
+
+		states[stage.Name] = Finished
+		statuses[stage.Name] = stage.Status
+		ready = append(ready, deps.finish(stage.Name)...)
+	}
+
+	if r.StartedAt == nil {
+		s.store.StartPipeline(p.Name)
+	}
+
+	// The goroutines are started once the containers of all the stages are known,
+	// as they read them to copy the artifacts
+	for _, stage := range unfinished {
+		if retry, ok := retries[stage.Name]; ok {
+			log.Printf("stage %s retries attempt %d at %s\n", stage.Name, retry.attempt, retry.retryAt)
+			go s.runStage(ctx, stage.Name, p, &retry, dependencyContainers(p.Stages[stage.Name], stageToContainerId), doneCh)
+		} else if l, ok := latest[stage.Name]; ok {
+			log.Printf("re-attaching stage %s to container %s\n", stage.Name, l.containerId)
+			go s.runStage(ctx, stage.Name, p, &l, dependencyContainers(p.Stages[stage.Name], stageToContainerId), doneCh)
+		} else if stage.Status == StatusQueued || recreate[stage.Name] {
+			go s.runStage(ctx, stage.Name, p, nil, dependencyContainers(p.Stages[stage.Name], stageToContainerId), doneCh)
+		} else {
+			log.Printf("the container of stage %s is lost\n", stage.Name)
+			doneCh <- StageOutput{Name: stage.Name, Message: lostContainerMessage, Status: -1, Attempt: stage.Attempt}
+		}
+	}
+
+	// The controller may have stopped while it was winding the pipeline down. A canceled
+	// or timed out pipeline is stopped again by run, with the status it was stopped with
+	if r.StopReason == StatusCanceled {
+		cancel()
+	}
+
+	if r.StopReason == "" {
+		for stage, status := range statuses {
+			// The pipelines stopped before their stop reason was stored only have canceled stages
+			if status == StatusCanceled {
+				cancel()
+			}
+
+			if status == StatusFailed || status == StatusTimedOut {
+				return s.fail(ctx, p, g, stage, states, statuses, stageToContainerId, doneCh)
+			}
+		}
+
+		s.startStages(ctx, p, ready, deps, states, statuses, stageToContainerId, doneCh)
+
+		if s.checkAllFinished(states) {
+			s.complete(p, statuses, stageToContainerId)
+			return nil
+		}
+	}
+
+	return s.run(ctx, p, g, deps, states, statuses, stageToContainerId, doneCh)
+}
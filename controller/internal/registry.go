@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Parses an image reference, e.g. "alpine", "ghcr.io/org/img" or "localhost:5000/team/img:tag",
+// into its full form. The images without a registry come from Docker Hub, and the
+// images without a tag nor a digest use the latest tag
+func parseImage(image string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image %s, %v", image, err)
+	}
+
+	return reference.TagNameOnly(named), nil
+}
+
+// Credentials to pull the images of a private registry
+type RegistryCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Finds the credentials of the registries the images are pulled from
+type RegistryAuth interface {
+	// Returns the credentials of a registry (e.g. "ghcr.io", "localhost:5000"),
+	// and false when the images of the registry are pulled anonymously
+	Credentials(registry string) (RegistryCredentials, bool, error)
+}
+
+// Credentials of the registries, keyed by registry, from the configuration of the controller
+type StaticRegistryAuth map[string]RegistryCredentials
+
+// Reads the credentials of the registries from a JSON file, e.g.
+// {"localhost:5000": {"username": "ci", "password": "secret"}}
+func LoadRegistryAuth(path string) (StaticRegistryAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth StaticRegistryAuth
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, fmt.Errorf("could not parse %s, %v", path, err)
+	}
+
+	return auth, nil
+}
+
+func (a StaticRegistryAuth) Credentials(registry string) (RegistryCredentials, bool, error) {
+	creds, ok := a[registry]
+	return creds, ok, nil
+}
+
+// Reads the credentials of the registries from Vault, where each registry
+// has a secret with the "username" and "password" keys at registries/<registry>
+type VaultRegistryAuth struct {
+	vault *VaultClient
+}
+
+// Creates a lookup of the registry credentials with the given Vault client
+func NewVaultRegistryAuth(vault *VaultClient) *VaultRegistryAuth {
+	return &VaultRegistryAuth{vault: vault}
+}
+
+func (a *VaultRegistryAuth) Credentials(registry string) (RegistryCredentials, bool, error) {
+	data, err := a.vault.ReadKV("registries/" + registry)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return RegistryCredentials{}, false, nil
+	}
+	if err != nil {
+		return RegistryCredentials{}, false, err
+	}
+
+	username, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if username == "" || password == "" {
+		return RegistryCredentials{}, false, fmt.Errorf("the credentials of registry %s need a username and a password", registry)
+	}
+
+	return RegistryCredentials{Username: username, Password: password}, true, nil
+}
+
+// Looks the credentials of a registry up in each RegistryAuth, in order,
+// returning the first ones found
+type RegistryAuthChain []RegistryAuth
+
+func (c RegistryAuthChain) Credentials(registry string) (RegistryCredentials, bool, error) {
+	for _, auth := range c {
+		creds, ok, err := auth.Credentials(registry)
+		if err != nil || ok {
+			return creds, ok, err
+		}
+	}
+
+	return RegistryCredentials{}, false, nil
+}
+
+// Encodes the credentials of a registry for the RegistryAuth option of ImagePull
+func encodeRegistryAuth(registry string, creds RegistryCredentials) (string, error) {
+	data, err := json.Marshal(types.AuthConfig{
+		Username:      creds.Username,
+		Password:      creds.Password,
+		ServerAddress: registry,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
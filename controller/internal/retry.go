@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Delay between two attempts when the retry policy does not set a max_backoff
+const defaultMaxBackoff = 5 * time.Minute
+
+// Retry policy of a stage. Must be an object with the keys
+// "max_attempts", "exit_codes", "backoff" and "max_backoff", e.g.
+//
+//	retry:
+//	  max_attempts: 3
+//	  exit_codes: [128]
+//	  backoff: 5s
+//	  max_backoff: 1m
+type RetryMeta struct {
+	// Total number of runs of the stage, including the first one
+	MaxAttempts int `json:"max_attempts"`
+
+	// Exit codes that trigger a new attempt
+	ExitCodes ExitCodes `json:"exit_codes"`
+
+	// Delay before the second attempt, doubled after every failed attempt
+	Backoff string `json:"backoff"`
+
+	// Longest delay between two attempts, 5 minutes by default
+	MaxBackoff string `json:"max_backoff"`
+}
+
+// A list of exit codes, or the string "any" to match all non-zero codes.
+// A missing list matches all non-zero codes as well
+type ExitCodes []int64
+
+func (e *ExitCodes) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		if value != "any" {
+			return fmt.Errorf("exit codes must be a list or \"any\", got %q", value)
+		}
+
+		*e = nil
+		return nil
+	}
+
+	var codes []int64
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return err
+	}
+
+	*e = codes
+	return nil
+}
+
+// Checks if a non-zero exit code triggers a new attempt
+func (e ExitCodes) matches(code int64) bool {
+	if len(e) == 0 {
+		return true
+	}
+
+	for _, c := range e {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *RetryMeta) validate() error {
+	if r == nil {
+		return nil
+	}
+
+	if r.MaxAttempts < 1 {
+		return errors.New("max_attempts must be at least 1")
+	}
+
+	if _, err := parseTimeout(r.Backoff); err != nil {
+		return fmt.Errorf("invalid backoff, %v", err)
+	}
+
+	if _, err := parseTimeout(r.MaxBackoff); err != nil {
+		return fmt.Errorf("invalid max_backoff, %v", err)
+	}
+
+	return nil
+}
+
+// Tells if the stage must be run again after the given output.
+// Successful, canceled and timed out attempts are never retried
+func (r *RetryMeta) shouldRetry(out StageOutput) bool {
+	if r == nil || out.Err != nil || out.Status == 0 {
+		return false
+	}
+
+	return out.Attempt < r.MaxAttempts && r.ExitCodes.matches(out.Status)
+}
+
+// Returns the delay before the attempt following the given one,
+// which stops doubling once it reaches max_backoff
+func (r *RetryMeta) backoff(attempt int) time.Duration {
+	d, _ := parseTimeout(r.Backoff)
+
+	limit, _ := parseTimeout(r.MaxBackoff)
+	if limit == 0 {
+		limit = defaultMaxBackoff
+	}
+
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+
+	if d > limit {
+		return limit
+	}
+
+	return d
+}
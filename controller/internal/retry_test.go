@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExitCodesUnmarshal(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    ExitCodes
+		wantErr bool
+	}{
+		{data: `[1, 137]`, want: ExitCodes{1, 137}},
+		{data: `"any"`, want: nil},
+		{data: `"some"`, wantErr: true},
+		{data: `[1, "2"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var got ExitCodes
+		err := json.Unmarshal([]byte(tt.data), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %v", tt.data, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr && len(got) != len(tt.want) {
+			t.Errorf("Unmarshal(%s) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	retry := &RetryMeta{MaxAttempts: 3, ExitCodes: ExitCodes{137}}
+
+	tests := []struct {
+		name  string
+		retry *RetryMeta
+		out   StageOutput
+		want  bool
+	}{
+		{"matching exit code", retry, StageOutput{Status: 137, Attempt: 1}, true},
+		{"other exit code", retry, StageOutput{Status: 1, Attempt: 1}, false},
+		{"last attempt", retry, StageOutput{Status: 137, Attempt: 3}, false},
+		{"success", retry, StageOutput{Status: 0, Attempt: 1}, false},
+		{"canceled", retry, StageOutput{Status: 137, Attempt: 1, Err: context.Canceled}, false},
+		{"timed out", retry, StageOutput{Status: 137, Attempt: 1, Err: context.DeadlineExceeded}, false},
+		{"any exit code", &RetryMeta{MaxAttempts: 2}, StageOutput{Status: 2, Attempt: 1}, true},
+		{"no retry policy", nil, StageOutput{Status: 1, Attempt: 1}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.retry.shouldRetry(tt.out); got != tt.want {
+			t.Errorf("%s: shouldRetry() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry   RetryMeta
+		attempt int
+		want    time.Duration
+	}{
+		{RetryMeta{}, 1, 0},
+		{RetryMeta{Backoff: "5s"}, 1, 5 * time.Second},
+		{RetryMeta{Backoff: "5s"}, 2, 10 * time.Second},
+		{RetryMeta{Backoff: "5s"}, 4, 40 * time.Second},
+		{RetryMeta{Backoff: "5s", MaxBackoff: "15s"}, 3, 15 * time.Second},
+		{RetryMeta{Backoff: "1m"}, 10, defaultMaxBackoff},
+		{RetryMeta{Backoff: "10m"}, 1, defaultMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := tt.retry.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%+v, %d) = %v, want %v", tt.retry, tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -3,45 +3,123 @@ package internal
 import (
 	"context"
 	"errors"
-	"io"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"os"
-	"strings"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/google/uuid"
-
-	"database/sql"
-
-	"github.com/lib/pq"
-	_ "github.com/lib/pq"
 )
 
 // A struct that represents the core scheduler for the CI system.
 // Configurations:
-// * maxContainers tells the scheduler the maximum number of running containers at a point in time.
+// * maxContainers tells the scheduler the maximum number of running containers at a point in time,
+// across all the pipelines. The ready stages wait in a FIFO queue for a free slot.
+// * executors are the ways of running the stages that the pipelines can choose from.
 type Scheduler struct {
 	maxContainers int
-	docker        *client.Client
-	db            *sql.DB
+	slots         *SlotQueue
+	store         Store
+
+	// Storage the artifacts are uploaded to. When nil, e.g. for local runs, the
+	// artifacts are only kept in the containers for the dependent stages
+	artifacts ArtifactStore
+
+	// Executors that can run the stages, keyed by name (e.g. "docker", "shell"),
+	// and the name of the one used by the pipelines that do not choose one
+	executors       map[string]Executor
+	defaultExecutor string
+
+	// Name of the controller, set as a label on the containers it creates
+	instance string
+
+	// Source of the secrets declared by the pipelines, which cannot use secrets when nil
+	secrets SecretStore
+
+	// Receives the logs of the stages while they run, when the executor can follow them
+	logSink LogSink
+
+	// How long the containers of a finished pipeline are kept before they are removed.
+	// When 0, they are removed as soon as the pipeline finishes
+	retention time.Duration
+
+	// Cancel functions of the pipelines that are currently scheduled, keyed by pipeline id
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
 }
 
-// A struct to represent the elements from the depends_on list
+// Returned by Cancel when there is no scheduled pipeline with the given id
+var ErrPipelineNotRunning = errors.New("pipeline is not running")
+
+// Statuses stored for the pipelines and the stages in the database
+const (
+	StatusQueued   = "QUEUED"
+	StatusPending  = "PENDING"
+	StatusRunning  = "RUNNING"
+	StatusSuccess  = "SUCCESS"
+	StatusFailed   = "FAILED"
+	StatusCanceled = "CANCELED"
+	StatusTimedOut = "TIMED_OUT"
+
+	// A failed stage that has allow_failure set
+	StatusFailedAllowed = "FAILED_ALLOWED"
+
+	// A stage that did not run because of the statuses of its dependencies
+	StatusSkipped = "SKIPPED"
+
+	// A pipeline that finished with allowed failures or skipped stages
+	StatusPassedWithWarnings = "PASSED_WITH_WARNINGS"
+)
+
+// Priority classes of the pipelines. The queued stages of a higher class get the
+// free container slots first. The class is taken as given by the client, as the
+// controller does not authenticate its users, so any user can ask for "high"
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// Ranks of the priority classes, a pipeline without priority being normal
+var priorityRanks = map[string]int{
+	PriorityLow:    0,
+	"":             1,
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+}
+
+// A struct to represent the elements from the depends_on list.
+// A dependency that did not succeed (e.g. it failed with allow_failure)
+// skips the stage when "require_success" or "artifacts" is set.
+// The artifacts are fetched into the working directory of the stage,
+// or into the "artifacts_path" directory of it when set
 type DependsOnMeta struct {
 	Stage          string `json:"stage"`
 	FetchArtifacts bool   `json:"artifacts"`
+	ArtifactsPath  string `json:"artifacts_path"`
+	RequireSuccess bool   `json:"require_success"`
 }
 
 // Metadata for each stage. Must be an object
-// with the keys "script", "depends_on", and "artifacts"
+// with the keys "script", "depends_on", and "artifacts".
+// The optional "timeout" key is a duration (e.g. "90s", "10m") after
+// which the stage container is killed, and the optional "retry" key
+// tells when the stage container should be run again after a failure.
+// A stage with "allow_failure" set does not abort the pipeline when it fails.
+// The optional "image" and "pull_policy" keys override the ones of the pipeline,
+// and the "variables" and "secrets" keys add to the ones of the pipeline
 type StageMeta struct {
-	Script    []string        `json:"script"`
-	DependsOn []DependsOnMeta `json:"depends_on"`
-	Artifacts []string        `json:"artifacts"`
+	Script       []string              `json:"script"`
+	DependsOn    []DependsOnMeta       `json:"depends_on"`
+	Artifacts    ArtifactsMeta         `json:"artifacts"`
+	Timeout      string                `json:"timeout"`
+	Retry        *RetryMeta            `json:"retry"`
+	AllowFailure bool                  `json:"allow_failure"`
+	Image        string                `json:"image"`
+	PullPolicy   string                `json:"pull_policy"`
+	Variables    map[string]string     `json:"variables"`
+	Secrets      map[string]SecretMeta `json:"secrets"`
 }
 
 // A struct to represent the JSON schema
@@ -53,18 +131,188 @@ type Pipeline struct {
 	// * This also adds unicity to the containers (not sure if they can be created with the same name, check ContainerCreate)
 	Name string
 
+	// Image of the stages that do not set their own
 	Image string `json:"image" schema:"image"`
 
+	// Pull policy of the images: "always", "if-not-present" (the default) or "never"
+	PullPolicy string `json:"pull_policy" schema:"pull_policy"`
+
+	// Name of the executor that runs the stages, e.g. "docker" or "shell".
+	// The default executor of the controller is used when empty
+	Executor string `json:"executor" schema:"executor"`
+
+	// Maximum duration of the whole pipeline, the running stages
+	// are killed and the remaining ones canceled when it is exceeded
+	Timeout string `json:"timeout" schema:"timeout"`
+
+	// Priority class of the pipeline: "low", "normal" (the default) or "high",
+	// trusted as is, so it relies on the users not all asking for "high"
+	Priority string `json:"priority" schema:"priority"`
+
+	// Environment variables of the stages, the values being the defaults of the parameters
+	Variables map[string]string `json:"variables" schema:"-"`
+
+	// Values given when running the pipeline, overriding the variables with the same names
+	Params map[string]string `json:"params" schema:"-"`
+
+	// Secrets of the stages, keyed by the name of their environment variable
+	Secrets map[string]SecretMeta `json:"secrets" schema:"-"`
+
+	// Id of the user that submitted the pipeline, set by the scheduler
+	UserId string `json:"-" schema:"-"`
+
 	// Allow for any Stages keys
 	Stages map[string]StageMeta `json:"stages"`
 }
 
+// Names the stages can have, as they are used in container names and in the paths of the shell executor
+var stageName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Checks the pipeline fields that cannot be validated by the JSON decoder
+func (p Pipeline) Validate() error {
+	if len(p.Stages) == 0 {
+		return errors.New("pipeline has no stages")
+	}
+
+	if _, err := NewGraphFromStages(p.Stages); err != nil {
+		return err
+	}
+	if _, err := parseTimeout(p.Timeout); err != nil {
+		return fmt.Errorf("invalid pipeline timeout, %v", err)
+	}
+
+	if _, ok := priorityRanks[p.Priority]; !ok {
+		return fmt.Errorf("invalid pipeline priority %s, must be one of %s, %s or %s", p.Priority, PriorityLow, PriorityNormal, PriorityHigh)
+	}
+
+	if err := validatePullPolicy(p.PullPolicy); err != nil {
+		return err
+	}
+
+	if err := p.validateVariables(); err != nil {
+		return err
+	}
+
+	if err := p.validateSecrets(); err != nil {
+		return err
+	}
+
+	for stage, meta := range p.Stages {
+		if !stageName.MatchString(stage) || stage == "." || stage == ".." {
+			return fmt.Errorf("invalid stage name %s, must only contain letters, digits, '.', '_' and '-'", stage)
+		}
+
+		if len(meta.Script) == 0 || meta.Script[0] == "" {
+			return fmt.Errorf("invalid stage %s, the script is empty", stage)
+		}
+
+		if image := p.stageImage(stage); image != "" {
+			if _, err := parseImage(image); err != nil {
+				return fmt.Errorf("invalid stage %s, %v", stage, err)
+			}
+		}
+
+		if err := validatePullPolicy(meta.PullPolicy); err != nil {
+			return fmt.Errorf("invalid stage %s, %v", stage, err)
+		}
+
+		if _, err := parseTimeout(meta.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout for stage %s, %v", stage, err)
+		}
+
+		if err := meta.Artifacts.validate(); err != nil {
+			return fmt.Errorf("invalid artifacts for stage %s, %v", stage, err)
+		}
+
+		if err := meta.Retry.validate(); err != nil {
+			return fmt.Errorf("invalid retry for stage %s, %v", stage, err)
+		}
+
+		for _, dep := range meta.DependsOn {
+			if err := validateArtifactsPath(dep.ArtifactsPath); err != nil {
+				return fmt.Errorf("invalid artifacts_path for stage %s, %v", stage, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Checks a pull policy, which uses the default one when empty
+func validatePullPolicy(policy string) error {
+	switch policy {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+		return nil
+	default:
+		return fmt.Errorf("invalid pull policy %s, must be one of %s, %s or %s", policy, PullAlways, PullIfNotPresent, PullNever)
+	}
+}
+
+// Returns the image of a stage, which is the one of the pipeline when the stage does not set one
+func (p Pipeline) stageImage(stage string) string {
+	if image := p.Stages[stage].Image; image != "" {
+		return image
+	}
+
+	return p.Image
+}
+
+// Returns the pull policy of the image of a stage
+func (p Pipeline) pullPolicy(stage string) string {
+	if policy := p.Stages[stage].PullPolicy; policy != "" {
+		return policy
+	}
+
+	if p.PullPolicy != "" {
+		return p.PullPolicy
+	}
+
+	return PullIfNotPresent
+}
+
+// Parses a timeout duration. An empty timeout means there is no limit
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+
+	return d, nil
+}
+
+// Derives a context that expires after the timeout, if there is one
+func withTimeout(ctx context.Context, timeout string) (context.Context, context.CancelFunc) {
+	d, _ := parseTimeout(timeout)
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
 type StageOutput struct {
 	Name         string
 	Message      string
 	Status       int64
 	ContainerId  string
 	ArtifactUrls []string
+
+	// The artifacts uploaded by the stage, with their metadata
+	Artifacts []Artifact
+
+	// Number of the attempt that produced this output, starting from 1
+	Attempt int
+
+	// Set when the stage was interrupted before the container exited
+	Err error
 }
 
 // Used to create an enum for the state of stages
@@ -79,166 +327,521 @@ const (
 
 // Creates a directed graph by iterating through
 // the list of dependencies found for each stage at "depends_on" key.
-// Cycles are detected automatically while adding the edges
-func NewGraphFromStages(stages map[string]StageMeta) *Graph {
+// Cycles and unknown stages are detected while adding the edges.
+// The stages without dependencies and dependents are nodes as well
+func NewGraphFromStages(stages map[string]StageMeta) (*Graph, error) {
 	g := NewGraph()
 
 	for k, v := range stages {
+		g.AddNode(k)
 		for _, dep := range v.DependsOn {
-			g.DependOn(k, dep.Stage)
+			if _, ok := stages[dep.Stage]; !ok {
+				return nil, fmt.Errorf("stage %s depends on unknown stage %s", k, dep.Stage)
+			}
+
+			if err := g.DependOn(k, dep.Stage); err != nil {
+				return nil, fmt.Errorf("invalid dependency of stage %s on %s, %v", k, dep.Stage, err)
+			}
 		}
 	}
 
-	return g
+	return g, nil
+}
+
+// Counts the dependencies of the stages that did not finish yet,
+// so that a stage is ready as soon as its last dependency finishes
+type dependencyCounter struct {
+	// Number of unfinished dependencies, keyed by stage
+	pending map[string]int
+
+	// Immediate dependents, keyed by stage
+	dependents map[string][]string
+}
+
+func newDependencyCounter(stages map[string]StageMeta) *dependencyCounter {
+	c := &dependencyCounter{
+		pending:    make(map[string]int),
+		dependents: make(map[string][]string),
+	}
+
+	for stage, meta := range stages {
+		c.pending[stage] += len(meta.DependsOn)
+		for _, dep := range meta.DependsOn {
+			c.dependents[dep.Stage] = append(c.dependents[dep.Stage], stage)
+		}
+	}
+
+	return c
+}
+
+// Returns the stages without dependencies, sorted by name
+func (c *dependencyCounter) ready() []string {
+	var ready []string
+	for stage, n := range c.pending {
+		if n == 0 {
+			ready = append(ready, stage)
+		}
+	}
+
+	sort.Strings(ready)
+	return ready
+}
+
+// Records that a stage finished and returns its dependents that became ready
+func (c *dependencyCounter) finish(stage string) []string {
+	var ready []string
+	for _, dependent := range c.dependents[stage] {
+		c.pending[dependent]--
+		if c.pending[dependent] == 0 {
+			ready = append(ready, dependent)
+		}
+	}
+
+	return ready
 }
 
 // Creates a new Scheduler struct with configurations.
-// Adds a new docker client to the new Scheduler struct
-func NewScheduler(maxContainers int, dbClient *sql.DB) *Scheduler {
-	docker, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		log.Fatalf("could not create docker client, %v", err)
+// The stages are run by one of the given executors, defaultExecutor being the
+// name of the one used when the pipeline does not have the "executor" key
+func NewScheduler(maxContainers int, store Store, executors map[string]Executor, defaultExecutor string) *Scheduler {
+	if _, ok := executors[defaultExecutor]; !ok {
+		log.Fatalf("the default executor %s is not available\n", defaultExecutor)
 	}
 
 	s := &Scheduler{
-		maxContainers: maxContainers,
-		docker:        docker,
-		db:            dbClient,
+		maxContainers:   maxContainers,
+		slots:           NewSlotQueue(maxContainers),
+		store:           store,
+		executors:       executors,
+		defaultExecutor: defaultExecutor,
+		cancels:         make(map[string]context.CancelFunc),
 	}
 
 	return s
 }
 
-// Function used by goroutines to run the pipeline stages
-func runStage(stage string, pipeline Pipeline, stageToContainerId map[string]string, docker *client.Client, doneCh chan StageOutput) {
-	ctx := context.Background()
+// Limits the number of stages of a single user running at the same time,
+// so that a user submitting many pipelines cannot take all the container slots
+func (s *Scheduler) SetMaxContainersPerUser(n int) {
+	s.slots.SetMaxPerUser(n)
+}
+
+// Sets the name of the controller, which is set as a label on the containers it creates
+func (s *Scheduler) SetInstance(instance string) {
+	s.instance = instance
+}
+
+// Reads the secrets declared by the pipelines from the given store
+func (s *Scheduler) SetSecretStore(secrets SecretStore) {
+	s.secrets = secrets
+}
+
+// Streams the logs of the stages to the given sink while their containers run
+func (s *Scheduler) SetLogSink(sink LogSink) {
+	s.logSink = sink
+}
+
+// Keeps the containers of the finished pipelines for the given duration, so that they
+// can be inspected, instead of removing them as soon as the pipelines finish
+func (s *Scheduler) SetContainerRetention(retention time.Duration) {
+	s.retention = retention
+}
+
+// Returns the position of a queued stage in the queue of the container slots,
+// starting from 1, or 0 when the stage is not waiting for a slot
+func (s *Scheduler) QueuePosition(pipelineId string, stage string) int {
+	return s.slots.Position(pipelineId, stage)
+}
+
+// Uploads the artifacts of the stages to the given storage
+func (s *Scheduler) SetArtifactStore(artifacts ArtifactStore) {
+	s.artifacts = artifacts
+}
+
+// Checks that a pipeline is valid and that its executor is available
+func (s *Scheduler) Validate(p Pipeline) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	if p.Executor != "" {
+		if _, ok := s.executors[p.Executor]; !ok {
+			return fmt.Errorf("executor %s is not available", p.Executor)
+		}
+	}
+
+	return nil
+}
+
+// Returns the executor that runs the stages of a pipeline
+func (s *Scheduler) executorFor(p Pipeline) Executor {
+	if p.Executor != "" {
+		return s.executors[p.Executor]
+	}
+
+	return s.executors[s.defaultExecutor]
+}
+
+// Function used by goroutines to run the pipeline stages.
+// The stage waits in the queue until a container slot is free and holds the
+// slot until its last attempt is done. The stage container is run again while
+// the retry policy of the stage allows it, each attempt being stored with its
+// own logs and exit code. A stage resumed after a restart of the controller
+// waits for the container of its last attempt first.
+// The containers of the dependencies are given by the caller, as the scheduler
+// keeps updating its own map while the stage runs.
+// The output of the last attempt is sent on doneCh
+func (s *Scheduler) runStage(ctx context.Context, stage string, pipeline Pipeline, resume *resumedAttempt, depContainers map[string]string, doneCh chan StageOutput) {
 	meta, ok := pipeline.Stages[stage]
 	if !ok {
-		log.Fatalf("cannot run stage %s\n", stage)
+		log.Printf("cannot run stage %s, it is not a stage of pipeline %s\n", stage, pipeline.Name)
+		doneCh <- StageOutput{Name: stage, Status: -1, Message: fmt.Sprintf("stage %s is not a stage of the pipeline\n", stage)}
+		return
+	}
+
+	first := 1
+	if resume != nil {
+		// The resumed attempt, or the stage waiting to retry, kept its slot during the restart
+		first = resume.attempt
+		s.slots.Reserve(pipeline.UserId)
+	} else {
+		err := s.slots.Acquire(ctx, pipeline.Name, pipeline.UserId, stage, priorityRanks[pipeline.Priority])
+		if err != nil {
+			doneCh <- StageOutput{Name: stage, Status: -1, Err: err}
+			return
+		}
+	}
+	defer s.slots.Release(pipeline.UserId)
+
+	// The controller stopped while the stage was waiting to retry
+	if resume != nil && resume.retryAt != nil {
+		select {
+		case <-ctx.Done():
+			doneCh <- StageOutput{Name: stage, Status: -1, Attempt: resume.attempt - 1, Err: ctx.Err()}
+			return
+		case <-time.After(time.Until(*resume.retryAt)):
+		}
 	}
 
-	imageFQDN := strings.Split(pipeline.Image, "/")
-	var registry, image string
+	for attempt := first; ; attempt++ {
+		var stageOut StageOutput
+		if resume != nil && attempt == resume.attempt && resume.containerId != "" {
+			stageOut = s.resumeAttempt(ctx, stage, pipeline, resume)
+		} else {
+			stageOut = s.runAttempt(ctx, stage, attempt, pipeline, depContainers)
+		}
+		s.store.InsertAttempt(pipeline.Name, stageOut)
 
-	if len(imageFQDN) == 2 {
-		registry = imageFQDN[0]
-		image = imageFQDN[1]
+		if !meta.Retry.shouldRetry(stageOut) {
+			// Send the stage name in the channel so the Scheduler can
+			// traverse the graph again and schedule new stages
+			doneCh <- stageOut
+			return
+		}
 
-	} else if len(imageFQDN) == 1 {
-		registry = "library"
-		image = imageFQDN[0]
+		// The retry is stored first, so that a restart during the backoff retries the stage.
+		// The container of the failed attempt is removed, so the next attempt can reuse the container name
+		backoff := meta.Retry.backoff(attempt)
+		s.store.SetStageRetry(pipeline.Name, stage, time.Now().Add(backoff))
+		s.executorFor(pipeline).Remove(context.Background(), stageOut.ContainerId)
 
-	} else {
-		log.Fatalf("image has wrong format, %s\n", imageFQDN)
+		log.Printf("stage %s failed with status %d on attempt %d, retrying in %s\n", stage, stageOut.Status, attempt, backoff)
+
+		select {
+		case <-ctx.Done():
+			stageOut.ContainerId = ""
+			stageOut.Err = ctx.Err()
+			doneCh <- stageOut
+			return
+		case <-time.After(backoff):
+		}
 	}
+}
 
-	reader, err := docker.ImagePull(ctx, "docker.io/"+registry+"/"+image, types.ImagePullOptions{})
+// Runs a single attempt of a stage in a new container.
+// When ctx is canceled the running container is stopped and the
+// stage output is returned with the context error and the logs written so far.
+// When the stage timeout is exceeded the container is killed instead
+func (s *Scheduler) runAttempt(ctx context.Context, stage string, attempt int, pipeline Pipeline, depContainers map[string]string) StageOutput {
+	meta := pipeline.Stages[stage]
+	executor := s.executorFor(pipeline)
+
+	// The image may be missing or misspelled, which fails the attempt rather than the controller
+	image := pipeline.stageImage(stage)
+	err := executor.PrepareImage(ctx, image, pipeline.pullPolicy(stage))
 	if err != nil {
-		panic(err)
-	}
+		if ctx.Err() != nil {
+			return StageOutput{Name: stage, Status: -1, Attempt: attempt, Err: ctx.Err()}
+		}
 
-	defer reader.Close()
-	io.Copy(os.Stdout, reader)
+		log.Printf("could not prepare image %s for stage %s, %v\n", image, stage, err)
+		return StageOutput{Name: stage, Status: -1, Attempt: attempt, Message: fmt.Sprintf("could not prepare image %s, %v\n", image, err)}
+	}
 
-	c, err := docker.ContainerCreate(ctx, &container.Config{
-		Image: pipeline.Image,
-		Cmd:   meta.Script,
-		Tty:   false,
-	}, nil, nil, nil, pipeline.Name+"-"+stage)
+	// The secrets are read for every attempt, as they may have changed since the last one
+	secrets, err := s.readSecrets(pipeline, stage)
+	if err != nil {
+		log.Printf("could not read the secrets of stage %s, %v\n", stage, err)
+		return StageOutput{Name: stage, Status: -1, Attempt: attempt, Message: fmt.Sprintf("%v\n", err)}
+	}
+	secretEnv, secretFiles := pipeline.secretsSpec(stage, secrets)
+
+	id, err := executor.Create(ctx, ContainerSpec{
+		Name:        pipeline.Name + "-" + stage,
+		Image:       image,
+		Cmd:         meta.Script,
+		Env:         append(pipeline.stageEnv(stage, attempt), secretEnv...),
+		SecretFiles: secretFiles,
+		Labels: map[string]string{
+			LabelPipeline: pipeline.Name,
+			LabelStage:    stage,
+			LabelAttempt:  strconv.Itoa(attempt),
+			LabelUser:     pipeline.UserId,
+			LabelInstance: s.instance,
+		},
+	})
 
 	if err != nil {
-		log.Fatalf("could not create container for stage %s, %v\n", stage, err)
+		if ctx.Err() != nil {
+			return StageOutput{Name: stage, Status: -1, Attempt: attempt, Err: ctx.Err()}
+		}
+
+		// e.g. a script the executor cannot run, which fails the stage rather than the controller
+		log.Printf("could not create container for stage %s, %v\n", stage, err)
+		return StageOutput{Name: stage, Status: -1, Attempt: attempt, Message: fmt.Sprintf("could not create the container, %v\n", err)}
 	}
 
+	s.store.SetStageContainer(pipeline.Name, stage, id, attempt)
+
 	for _, d := range meta.DependsOn {
-		if d.FetchArtifacts {
-			for _, f := range pipeline.Stages[d.Stage].Artifacts {
-				CopyFromContainerToContainer(docker, stageToContainerId[d.Stage], f, c.ID, "./")
+		if !d.FetchArtifacts {
+			continue
+		}
+
+		// Without an artifact storage, e.g. on a local run, the artifacts
+		// are copied from the container of the dependency, which must still exist
+		if s.artifacts == nil {
+			CopyFromContainerToContainer(executor, depContainers[d.Stage], pipeline.Stages[d.Stage].Artifacts, id, d.ArtifactsPath)
+			continue
+		}
+
+		// The dependency may have matched no file, or its artifacts may have expired
+		artifacts := s.store.Artifacts(pipeline.Name, d.Stage)
+		if len(artifacts) == 0 && len(pipeline.Stages[d.Stage].Artifacts.Paths) > 0 {
+			log.Printf("no artifacts of stage %s to fetch for stage %s\n", d.Stage, stage)
+			return StageOutput{Name: stage, Status: -1, Attempt: attempt, ContainerId: id, Message: fmt.Sprintf("could not fetch the artifacts of stage %s, no artifact was uploaded or they expired\n", d.Stage)}
+		}
+
+		err = DownloadArtifactsToContainer(ctx, executor, s.artifacts, artifacts, id, d.ArtifactsPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return StageOutput{Name: stage, Status: -1, Attempt: attempt, ContainerId: id, Err: ctx.Err()}
 			}
+
+			log.Printf("could not fetch the artifacts of stage %s for stage %s, %v\n", d.Stage, stage, err)
+			return StageOutput{Name: stage, Status: -1, Attempt: attempt, ContainerId: id, Message: fmt.Sprintf("could not fetch the artifacts of stage %s, %v\n", d.Stage, err)}
 		}
 	}
 
-	err = docker.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
+	// The stage timeout only covers the execution of the container
+	ctx, cancel := withTimeout(ctx, meta.Timeout)
+	defer cancel()
+
+	err = executor.Start(ctx, id)
 	if err != nil {
-		log.Fatalf("could not start container, %v\n", err)
+		if ctx.Err() != nil {
+			return StageOutput{Name: stage, Status: -1, Attempt: attempt, ContainerId: id, Err: ctx.Err()}
+		}
+
+		// e.g. a command that is not in the PATH
+		log.Printf("could not start container %s of stage %s, %v\n", id, stage, err)
+		return StageOutput{Name: stage, Status: -1, Attempt: attempt, ContainerId: id, Message: fmt.Sprintf("could not start the container, %v\n", err)}
 	}
 
-	statusCh, errCh := docker.ContainerWait(ctx, c.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		if err != nil {
-			log.Fatalf("could not wait for container, %v\n", err)
-		}
-	case status := <-statusCh:
-		log.Printf("received status code on wait channel %d\n", status.StatusCode)
-		artifactUrls := make([]string, len(meta.Artifacts))
+	s.store.StartStage(pipeline.Name, stage)
 
-		// Send all artifacts to S3 only if the stage finished successfully
-		if status.StatusCode == 0 {
-			for _, f := range meta.Artifacts {
-				log.Printf("uploading artifact %s to S3\n", f)
-				artifactUrls = append(artifactUrls, UploadArtifactFromContainer(docker, pipeline.Name, stage, c.ID, f))
-			}
-		}
+	return s.waitAttempt(ctx, stage, attempt, pipeline, id, secrets)
+}
 
-		// Write logs to STDOUT
-		out, err := docker.ContainerLogs(ctx, c.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
-		if err != nil {
-			panic(err)
+// Waits for the container of an attempt that was started before the controller
+// restarted. The stage timeout counts from the time the container started
+func (s *Scheduler) resumeAttempt(ctx context.Context, stage string, pipeline Pipeline, resume *resumedAttempt) StageOutput {
+	ctx, cancel := resumeContext(ctx, pipeline.Stages[stage].Timeout, resume.startedAt)
+	defer cancel()
+
+	attempt := resume.attempt
+	id := resume.containerId
+
+	// The secrets are only needed to mask the logs, which are dropped when they cannot be read
+	secrets, err := s.readSecrets(pipeline, stage)
+	if err != nil {
+		log.Printf("could not read the secrets of stage %s, %v\n", stage, err)
+		out := s.waitAttempt(ctx, stage, attempt, pipeline, id, nil)
+		out.Message = fmt.Sprintf("the logs are hidden, as the secrets to mask could not be read, %v\n", err)
+		return out
+	}
+
+	return s.waitAttempt(ctx, stage, attempt, pipeline, id, secrets)
+}
+
+// Waits for the container of a started attempt to exit and collects its output,
+// with the values of the secrets masked out of the logs.
+// The container is stopped when ctx is done before it exits
+func (s *Scheduler) waitAttempt(ctx context.Context, stage string, attempt int, pipeline Pipeline, id string, secrets map[string]string) StageOutput {
+	meta := pipeline.Stages[stage]
+	executor := s.executorFor(pipeline)
+
+	stopFollowing := s.followLogs(pipeline, stage, id, secrets)
+	statusCode, err := executor.Wait(ctx, id)
+	if err != nil && ctx.Err() == nil {
+		// The container is killed, as the scheduler cannot tell when it exits anymore
+		log.Printf("could not wait for container %s of stage %s, %v\n", id, stage, err)
+		if err := executor.Kill(context.Background(), id); err != nil {
+			log.Printf("could not kill container %s, %v\n", id, err)
 		}
+		stopFollowing()
+
+		return StageOutput{
+			Name:        stage,
+			Message:     maskSecrets(containerLogs(executor, id), secrets) + fmt.Sprintf("could not wait for the container, %v\n", err),
+			Status:      -1,
+			Attempt:     attempt,
+			ContainerId: id,
+		}
+	}
+	if err != nil {
 
-		outBytes, err := ioutil.ReadAll(out)
+		// The stage was canceled or timed out, so the container is
+		// stopped and the partial logs are kept for the stage record
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("stage %s timed out, killing container %s\n", stage, id)
+			err = executor.Kill(context.Background(), id)
+		} else {
+			log.Printf("stage %s was interrupted, stopping container %s\n", stage, id)
+			err = executor.Stop(context.Background(), id)
+		}
 		if err != nil {
-			panic(err)
+			log.Printf("could not stop container %s, %v\n", id, err)
 		}
+		stopFollowing()
 
+		// The artifacts uploaded on failure may help finding why the stage did not finish
 		stageOut := StageOutput{
-			Name:         stage,
-			Message:      string(ReplaceControlBytes(outBytes)),
-			Status:       status.StatusCode,
-			ContainerId:  c.ID,
-			ArtifactUrls: artifactUrls,
+			Name:        stage,
+			Message:     maskSecrets(containerLogs(executor, id), secrets),
+			Status:      -1,
+			Attempt:     attempt,
+			ContainerId: id,
+			Err:         ctx.Err(),
 		}
+		s.uploadArtifacts(&stageOut, pipeline, meta)
+
+		return stageOut
+	}
 
-		// Send the stage name in the channel so the Scheduler can
-		// traverse the graph again and schedule new stages
-		doneCh <- stageOut
+	stopFollowing()
+	log.Printf("received status code on wait channel %d\n", statusCode)
+	stageOut := StageOutput{
+		Name:        stage,
+		Message:     maskSecrets(containerLogs(executor, id), secrets),
+		Status:      statusCode,
+		Attempt:     attempt,
+		ContainerId: id,
 	}
+	s.uploadArtifacts(&stageOut, pipeline, meta)
+
+	return stageOut
 }
 
-// Find next stages to run by traversing the stage layers.
-// This function is called after one dependency stage finishes
-func (s *Scheduler) findNextStages(p Pipeline, states map[string]StageState, layers [][]string) []string {
-	var nextStages []string
+// Uploads the artifacts of an attempt when its exit code allows it, on success by default.
+// An artifact that could not be uploaded fails the attempt, as the dependent stages
+// and the users downloading it would otherwise miss it
+func (s *Scheduler) uploadArtifacts(stageOut *StageOutput, pipeline Pipeline, meta StageMeta) {
+	if s.artifacts == nil || !meta.Artifacts.upload(stageOut.Status) {
+		return
+	}
 
-	// The layers array is assured to have at least 2 elements
-	for i := 1; i < len(layers); i++ {
-		for _, stage := range layers[i] {
-			// Stages already running are skippedDependsOn
-			if states[stage] == Running || states[stage] == Finished {
-				continue
+	executor := s.executorFor(pipeline)
+	for _, p := range meta.Artifacts.Paths {
+		log.Printf("uploading artifacts %s\n", p)
+		uploaded, err := UploadArtifactsFromContainer(executor, s.artifacts, pipeline.Name, stageOut.Name, stageOut.ContainerId, p, meta.Artifacts)
+		if err != nil {
+			log.Printf("could not upload artifacts %s of stage %s, %v\n", p, stageOut.Name, err)
+			stageOut.Message += fmt.Sprintf("could not upload artifacts %s, %v\n", p, err)
+			if stageOut.Status == 0 {
+				stageOut.Status = -1
 			}
+		}
 
-			// Iterate through the stage dependencies and check
-			// their statuses
-			allDone := true
-			for _, dep := range p.Stages[stage].DependsOn {
-				// If any stage dependency is in either NotRunning or Running states,
-				// the stage is not considered in the next run
-				if states[dep.Stage] == Running || states[dep.Stage] == NotRunning {
-					allDone = false
-					break
-				}
-			}
+		for _, artifact := range uploaded {
+			stageOut.Artifacts = append(stageOut.Artifacts, artifact)
+			stageOut.ArtifactUrls = append(stageOut.ArtifactUrls, artifact.Location)
+		}
+	}
+}
 
-			// Add the stage to the next run if dependencies finished
-			if allDone {
-				nextStages = append(nextStages, stage)
-			}
+// Reads the stdout and stderr of a container, without the control bytes.
+// A background context is used, as the stage context may be already canceled.
+// The logs that cannot be read are replaced by the error, for the stage record
+func containerLogs(executor Executor, containerId string) string {
+	outBytes, err := executor.Logs(context.Background(), containerId)
+	if err != nil {
+		log.Printf("could not read the logs of container %s, %v\n", containerId, err)
+		return fmt.Sprintf("could not read the logs of the container, %v\n", err)
+	}
+
+	return string(ReplaceControlBytes(outBytes))
+}
+
+// Tells if a stage must be skipped because of the statuses of its dependencies
+func shouldSkip(meta StageMeta, statuses map[string]string) bool {
+	for _, dep := range meta.DependsOn {
+		if statuses[dep.Stage] != StatusSuccess && (dep.RequireSuccess || dep.FetchArtifacts) {
+			return true
 		}
 	}
 
-	return nextStages
+	return false
+}
+
+// Starts the stages that are ready. The stages that must be skipped are marked
+// as finished right away, which makes their dependents ready in turn
+func (s *Scheduler) startStages(ctx context.Context, p Pipeline, ready []string, deps *dependencyCounter, states map[string]StageState, statuses map[string]string, stageToContainerId map[string]string, doneCh chan StageOutput) {
+	for len(ready) > 0 {
+		stage := ready[0]
+		ready = ready[1:]
+
+		// The stage may have been skipped already because a stage it depends on failed
+		if states[stage] != NotRunning {
+			continue
+		}
+
+		if shouldSkip(p.Stages[stage], statuses) {
+			log.Printf("skipping stage %s\n", stage)
+			states[stage] = Finished
+			statuses[stage] = StatusSkipped
+			s.store.InsertStage(p.Name, stage, StatusSkipped)
+
+			ready = append(ready, deps.finish(stage)...)
+			continue
+		}
+
+		log.Printf("starting stage %s\n", stage)
+		states[stage] = Running
+		s.store.InsertStage(p.Name, stage, StatusQueued)
+
+		go s.runStage(ctx, stage, p, nil, dependencyContainers(p.Stages[stage], stageToContainerId), doneCh)
+	}
+}
+
+// Copies the containers of the dependencies of a stage, keyed by stage
+func dependencyContainers(meta StageMeta, stageToContainerId map[string]string) map[string]string {
+	containers := make(map[string]string)
+	for _, d := range meta.DependsOn {
+		containers[d.Stage] = stageToContainerId[d.Stage]
+	}
+
+	return containers
 }
 
 // Check if all stages have finished
@@ -252,9 +855,191 @@ func (s *Scheduler) checkAllFinished(states map[string]StageState) bool {
 	return true
 }
 
+// Cancels a scheduled pipeline. The running stages are stopped and the
+// stages that did not start yet are marked as canceled by Schedule
+func (s *Scheduler) Cancel(pipelineId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancel, ok := s.cancels[pipelineId]
+	if !ok {
+		return ErrPipelineNotRunning
+	}
+
+	cancel()
+	return nil
+}
+
+// Maps the output of a finished stage to the status stored in the database
+func stageStatus(out StageOutput) string {
+	if errors.Is(out.Err, errSlotWithdrawn) {
+		return StatusSkipped
+	}
+
+	if out.Err != nil {
+		return contextStatus(out.Err)
+	}
+
+	if out.Status != 0 {
+		return StatusFailed
+	}
+
+	return StatusSuccess
+}
+
+// Maps the error of a canceled or timed out context to a status
+func contextStatus(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return StatusTimedOut
+	}
+
+	return StatusCanceled
+}
+
+// Records the output of a finished stage and returns its status.
+// A stage that timed out is failed as well, unless the failure is allowed
+func (s *Scheduler) finishStage(ctx context.Context, p Pipeline, out StageOutput, states map[string]StageState, statuses map[string]string, stageToContainerId map[string]string) string {
+	if out.ContainerId != "" {
+		stageToContainerId[out.Name] = out.ContainerId
+	}
+
+	status := stageStatus(out)
+	if ctx.Err() == nil && p.Stages[out.Name].AllowFailure && (status == StatusFailed || status == StatusTimedOut) {
+		status = StatusFailedAllowed
+	}
+
+	log.Printf("stage %s is done with status %s and container %s\n", out.Name, status, out.ContainerId)
+
+	// Mark the stage as done, so that the stage won't run again
+	states[out.Name] = Finished
+	statuses[out.Name] = status
+	s.store.FinishStage(p.Name, out, status)
+
+	return status
+}
+
+// Winds down a pipeline that cannot continue: waits for the running stages to finish
+// (they are stopped first when the pipeline is canceled or timed out), records the
+// stages that never started with the given status and removes all the containers
+func (s *Scheduler) abort(ctx context.Context, p Pipeline, states map[string]StageState, statuses map[string]string, stageToContainerId map[string]string, doneCh chan StageOutput, notStartedStatus string) {
+	for {
+		running := 0
+		for _, state := range states {
+			if state == Running {
+				running++
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		log.Printf("waiting for %d running stages of pipeline %s\n", running, p.Name)
+		s.finishStage(ctx, p, <-doneCh, states, statuses, stageToContainerId)
+	}
+
+	for stage, state := range states {
+		if state != NotRunning {
+			continue
+		}
+
+		states[stage] = Finished
+		statuses[stage] = notStartedStatus
+		s.store.InsertStage(p.Name, stage, notStartedStatus)
+	}
+
+	s.removeContainers(p, stageToContainerId)
+}
+
+// Removes the containers of a finished pipeline, unless they are kept
+// for a while, in which case they are removed later by the reaper
+func (s *Scheduler) removeContainers(p Pipeline, stageToContainerId map[string]string) {
+	if s.retention > 0 {
+		return
+	}
+
+	for _, v := range stageToContainerId {
+		if v != "" {
+			s.executorFor(p).Remove(context.Background(), v)
+		}
+	}
+}
+
+// Tells if a pipeline is currently scheduled
+func (s *Scheduler) scheduled(pipelineId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.cancels[pipelineId]
+	return ok
+}
+
+// Registers the cancel function of a scheduled pipeline
+// and returns the function to call once the pipeline finished
+func (s *Scheduler) track(pipelineId string, cancel context.CancelFunc) func() {
+	s.mu.Lock()
+	s.cancels[pipelineId] = cancel
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.cancels, pipelineId)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// Aborts a pipeline because one of its stages failed
+func (s *Scheduler) fail(ctx context.Context, p Pipeline, g *Graph, failed string, states map[string]StageState, statuses map[string]string, stageToContainerId map[string]string, doneCh chan StageOutput) error {
+	// The stages depending on the failed one are skipped right away,
+	// the other ones that did not start are skipped once the
+	// running stages are done
+	for dependent := range g.Dependents(failed) {
+		if states[dependent] == NotRunning {
+			states[dependent] = Finished
+			statuses[dependent] = StatusSkipped
+			s.store.InsertStage(p.Name, dependent, StatusSkipped)
+		}
+	}
+
+	// The queued stages are skipped as well, instead of waiting for a slot
+	s.slots.Withdraw(p.Name)
+
+	s.abort(ctx, p, states, statuses, stageToContainerId, doneCh, StatusSkipped)
+	s.store.FinishPipeline(p.Name, StatusFailed)
+	return errors.New("ABORT")
+}
+
+// Finishes a pipeline whose stages all finished without failing it
+func (s *Scheduler) complete(p Pipeline, statuses map[string]string, stageToContainerId map[string]string) {
+	pipelineStatus := StatusSuccess
+	for _, status := range statuses {
+		if status != StatusSuccess {
+			pipelineStatus = StatusPassedWithWarnings
+		}
+	}
+
+	log.Printf("pipeline finished with status %s, closing the client\n", pipelineStatus)
+
+	s.removeContainers(p, stageToContainerId)
+
+	s.store.FinishPipeline(p.Name, pipelineStatus)
+}
+
+// Runs the stages of a pipeline in the order given by their dependencies.
+// The pipeline name must be set by the caller, as it is the id used to cancel the pipeline.
+// The ip of the caller identifies the user sharing the container slots with the others
 func (s *Scheduler) Schedule(p Pipeline, ip string) error {
-	stageToContainerId := make(map[string]string)
-	p.Name = uuid.New().String()
+	return <-s.Submit(p, ip)
+}
+
+// Stores a pipeline and runs its stages in the background. The pipeline can be
+// canceled as soon as Submit returns, and the returned channel receives the
+// result of Schedule once the pipeline finished
+func (s *Scheduler) Submit(p Pipeline, ip string) <-chan error {
+	p.UserId = ip
+	ctx, cancel := withTimeout(context.Background(), p.Timeout)
+	untrack := s.track(p.Name, cancel)
 
 	// Build the data for the DAG and store it in database
 	var dependencies [][]string
@@ -264,21 +1049,32 @@ func (s *Scheduler) Schedule(p Pipeline, ip string) error {
 		}
 	}
 
-	_, err := s.db.Exec("INSERT INTO pipelines (id, user_id, dependencies) VALUES ($1, $2, $3)", p.Name, ip, pq.Array(dependencies))
-	if err != nil {
-		log.Fatalf("Error executing query: %q", err)
-	}
+	s.store.InsertPipeline(p, dependencies)
 
-	g := NewGraphFromStages(p.Stages)
-	layers := g.TopoSortedLayers()
+	result := make(chan error, 1)
+	go func() {
+		err := s.schedule(ctx, p)
+		untrack()
+		result <- err
+	}()
 
-	for i, layer := range layers {
-		log.Printf("%d: %s\n", i, layer)
-	}
+	return result
+}
+
+// Runs the stages of a stored pipeline until it finishes or ctx is done
+func (s *Scheduler) schedule(ctx context.Context, p Pipeline) error {
+	stageToContainerId := make(map[string]string)
+
+	// The pipeline was validated, so the graph has no cycles
+	g, _ := NewGraphFromStages(p.Stages)
+	deps := newDependencyCounter(p.Stages)
 
-	// Create a channel to receive the stage names that finished
-	// Buffered with a maximum capacity of maxContainers
-	doneCh := make(chan StageOutput, s.maxContainers)
+	// Create a channel to receive the outputs of the finished stages,
+	// buffered so that no stage goroutine waits for the scheduler
+	doneCh := make(chan StageOutput, len(p.Stages))
+
+	// Create a map to hold the database statuses of the finished stages
+	statuses := make(map[string]string)
 
 	// Create a map to hold the stages that finished
 	states := make(map[string]StageState)
@@ -287,106 +1083,51 @@ func (s *Scheduler) Schedule(p Pipeline, ip string) error {
 		states[stage] = NotRunning
 	}
 
-	// Create a new slice to store the initial layer of stages to be executed
-	var first []string
-	// Number of existing stage layers
-	layersLen := len(layers)
-
-	if layersLen > 0 {
-		first = layers[0]
-
-		// Case when the pipeline has only one stage
-	} else if len(p.Stages) == 1 {
-		first = make([]string, 1)
-		for k := range p.Stages {
-			first[0] = k
-		}
-
-		// Case when the pipeline has no stages
-	} else {
-		log.Fatal("there are no stage layers, recheck your pipeline\n")
-	}
-
-	log.Printf("the first stage layer to be executed: %s\n", first)
-	// Run the first stage layer by creating a goroutine per stage
-	for _, stage := range first {
-		log.Printf("starting stage %s\n", stage)
-		states[stage] = Running
+	first := deps.ready()
+	log.Printf("the first stages to be executed: %s\n", first)
+	s.store.StartPipeline(p.Name)
 
-		_, err := s.db.Exec("INSERT INTO stages (pipeline_id, name, status) VALUES ($1, $2, $3)",
-			p.Name, stage, "RUNNING")
-		if err != nil {
-			log.Fatalf("Error executing query: %q", err)
-		}
+	// Queue the first stages by creating a goroutine per stage
+	s.startStages(ctx, p, first, deps, states, statuses, stageToContainerId, doneCh)
 
-		go runStage(stage, p, stageToContainerId, s.docker, doneCh)
-	}
+	return s.run(ctx, p, g, deps, states, statuses, stageToContainerId, doneCh)
+}
 
+// Waits for the stages to finish, the pipeline being canceled or its timeout
+// being exceeded. The dependents of a finished stage start right away
+func (s *Scheduler) run(ctx context.Context, p Pipeline, g *Graph, deps *dependencyCounter, states map[string]StageState, statuses map[string]string, stageToContainerId map[string]string, doneCh chan StageOutput) error {
 	for {
 		select {
+		case <-ctx.Done():
+			log.Printf("pipeline %s stopped, %v\n", p.Name, ctx.Err())
+			s.store.StopPipeline(p.Name, contextStatus(ctx.Err()))
+			s.abort(ctx, p, states, statuses, stageToContainerId, doneCh, StatusCanceled)
+			s.store.FinishPipeline(p.Name, contextStatus(ctx.Err()))
+			return ctx.Err()
+
 		case stageOutput := <-doneCh:
-			stageToContainerId[stageOutput.Name] = stageOutput.ContainerId
-			log.Printf("stage %s is done with status %d and container %s\n", stageOutput.Name, stageOutput.Status, stageOutput.ContainerId)
+			status := s.finishStage(ctx, p, stageOutput, states, statuses, stageToContainerId)
+
+			if ctx.Err() != nil {
+				log.Printf("pipeline %s stopped, %v\n", p.Name, ctx.Err())
+				s.store.StopPipeline(p.Name, contextStatus(ctx.Err()))
+				s.abort(ctx, p, states, statuses, stageToContainerId, doneCh, StatusCanceled)
+				s.store.FinishPipeline(p.Name, contextStatus(ctx.Err()))
+				return ctx.Err()
+			}
 
-			if stageOutput.Status != 0 {
+			if status == StatusFailed || status == StatusTimedOut {
 				log.Printf("stage %s is failed with message %s, aborting pipeline\n", stageOutput.Name, stageOutput.Message)
-
-				_, err := s.db.Exec("UPDATE stages SET status = $1, message = $2 WHERE pipeline_id = $3 AND name = $4",
-					"FAILED", stageOutput.Message, p.Name, stageOutput.Name)
-				if err != nil {
-					log.Fatalf("Error executing query: %q", err)
-				}
-
-				return errors.New("ABORT")
+				return s.fail(ctx, p, g, stageOutput.Name, states, statuses, stageToContainerId, doneCh)
 			}
 
-			// Mark the stage as done, so that the stage won't run again
-			states[stageOutput.Name] = Finished
-
-			psqlArr := pq.Array(stageOutput.ArtifactUrls)
-
-			_, err := s.db.Exec("UPDATE stages SET status = $1, message = $2, artifact_urls = $3 WHERE pipeline_id = $4 AND name = $5",
-				"SUCCESS", stageOutput.Message, psqlArr, p.Name, stageOutput.Name)
-			if err != nil {
-				log.Fatalf("Error executing query: %q", err)
-			}
+			s.startStages(ctx, p, deps.finish(stageOutput.Name), deps, states, statuses, stageToContainerId, doneCh)
 
 			// Check if all stages finished
 			if s.checkAllFinished(states) {
-				log.Printf("pipeline finished successfully, closing the client\n")
-
-				// Remove the containers
-				for _, v := range stageToContainerId {
-					s.docker.ContainerRemove(context.Background(), v, types.ContainerRemoveOptions{})
-				}
+				s.complete(p, statuses, stageToContainerId)
 				return nil
 			}
-
-			// 1 layer means all stages have no dependencies
-			// > 1 layers means there are dependencies
-			// Look for stages starting with the second layer
-			if len(layers) > 1 {
-				log.Printf("looking for other stages to run...\n")
-				nextStages := s.findNextStages(p, states, layers)
-				log.Printf("found next stages: %s\n", nextStages)
-
-				// Run the next stages and set their status to Running
-				for _, n := range nextStages {
-					states[n] = Running
-
-					_, err := s.db.Exec("INSERT INTO stages (pipeline_id, name, status) VALUES ($1, $2, $3)",
-						p.Name, n, "RUNNING")
-					if err != nil {
-						log.Fatalf("Error executing query: %q", err)
-					}
-
-					go runStage(n, p, stageToContainerId, s.docker, doneCh)
-				}
-			}
-
-		default:
-			// Waiting for any stage to finish
-			time.Sleep(1 * time.Second)
 		}
 	}
 }
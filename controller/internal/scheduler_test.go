@@ -0,0 +1,443 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store that keeps the statuses of a single pipeline in memory
+type memStore struct {
+	mu       sync.Mutex
+	status   string
+	stages   map[string]string
+	attempts map[string][]StageOutput
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		stages:   make(map[string]string),
+		attempts: make(map[string][]StageOutput),
+	}
+}
+
+func (s *memStore) InsertPipeline(p Pipeline, dependencies [][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = StatusQueued
+}
+
+func (s *memStore) StartPipeline(pipelineId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = StatusRunning
+}
+
+func (s *memStore) ResumePipeline(pipelineId string) {
+}
+
+func (s *memStore) StopPipeline(pipelineId string, status string) {
+}
+
+func (s *memStore) FinishPipeline(pipelineId string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = status
+}
+
+func (s *memStore) InsertStage(pipelineId string, stage string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages[stage] = status
+}
+
+func (s *memStore) StartStage(pipelineId string, stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages[stage] = StatusRunning
+}
+
+func (s *memStore) FinishStage(pipelineId string, out StageOutput, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages[out.Name] = status
+}
+
+func (s *memStore) InsertAttempt(pipelineId string, out StageOutput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts[out.Name] = append(s.attempts[out.Name], out)
+}
+
+func (s *memStore) SetStageContainer(pipelineId string, stage string, containerId string, attempt int) {
+}
+
+func (s *memStore) SetStageRetry(pipelineId string, stage string, nextAttemptAt time.Time) {
+}
+
+func (s *memStore) UnfinishedPipelines() []RecoveredPipeline {
+	return nil
+}
+
+func (s *memStore) FinishedAt(pipelineId string) (*time.Time, bool) {
+	return nil, false
+}
+
+func (s *memStore) Artifacts(pipelineId string, stage string) []Artifact {
+	return nil
+}
+
+func (s *memStore) ExpiredArtifacts() []string {
+	return nil
+}
+
+func (s *memStore) DeleteArtifact(key string) {
+}
+
+// Returns the stored status of the pipeline and of its stages
+func (s *memStore) statuses() (string, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stages := make(map[string]string)
+	for name, status := range s.stages {
+		stages[name] = status
+	}
+
+	return s.status, stages
+}
+
+// Creates a scheduler running the stages with a fake executor, whose
+// containers get the outcome given by results for their stage
+func newTestScheduler(results map[string]FakeResult) (*Scheduler, *FakeExecutor, *memStore) {
+	executor := NewFakeExecutor(func(spec ContainerSpec) FakeResult {
+		return results[strings.TrimPrefix(spec.Name, "p-")]
+	})
+	store := newMemStore()
+
+	return NewScheduler(10, store, map[string]Executor{"fake": executor}, "fake"), executor, store
+}
+
+// Creates a stage depending on the given ones
+func testStage(dependsOn ...string) StageMeta {
+	meta := StageMeta{Script: []string{"true"}}
+	for _, d := range dependsOn {
+		meta.DependsOn = append(meta.DependsOn, DependsOnMeta{Stage: d})
+	}
+
+	return meta
+}
+
+// Returns the position of every started stage, keyed by stage name
+func startOrder(executor *FakeExecutor) map[string]int {
+	order := make(map[string]int)
+	for i, name := range executor.Started() {
+		order[strings.TrimPrefix(name, "p-")] = i
+	}
+
+	return order
+}
+
+func checkStatuses(t *testing.T, store *memStore, pipeline string, stages map[string]string) {
+	t.Helper()
+
+	status, statuses := store.statuses()
+	if status != pipeline {
+		t.Errorf("pipeline status is %s, want %s", status, pipeline)
+	}
+
+	for name, want := range stages {
+		if statuses[name] != want {
+			t.Errorf("stage %s status is %s, want %s", name, statuses[name], want)
+		}
+	}
+}
+
+func TestScheduleLinear(t *testing.T) {
+	s, executor, store := newTestScheduler(nil)
+
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": testStage(),
+		"b": testStage("a"),
+		"c": testStage("b"),
+	}}
+	if err := s.Schedule(p, "user"); err != nil {
+		t.Fatalf("Schedule() = %v", err)
+	}
+
+	checkStatuses(t, store, StatusSuccess, map[string]string{"a": StatusSuccess, "b": StatusSuccess, "c": StatusSuccess})
+
+	started := executor.Started()
+	if strings.Join(started, ",") != "p-a,p-b,p-c" {
+		t.Errorf("started %v, want p-a, p-b and p-c in order", started)
+	}
+}
+
+func TestScheduleDiamond(t *testing.T) {
+	s, executor, store := newTestScheduler(map[string]FakeResult{
+		"b": {Duration: 20 * time.Millisecond},
+		"c": {Duration: 10 * time.Millisecond},
+	})
+
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": testStage(),
+		"b": testStage("a"),
+		"c": testStage("a"),
+		"d": testStage("b", "c"),
+	}}
+	if err := s.Schedule(p, "user"); err != nil {
+		t.Fatalf("Schedule() = %v", err)
+	}
+
+	checkStatuses(t, store, StatusSuccess, map[string]string{"a": StatusSuccess, "b": StatusSuccess, "c": StatusSuccess, "d": StatusSuccess})
+
+	order := startOrder(executor)
+	if len(order) != 4 || order["a"] != 0 || order["d"] != 3 {
+		t.Errorf("started %v, want a first and d last", executor.Started())
+	}
+}
+
+func TestScheduleIsolatedStage(t *testing.T) {
+	s, executor, store := newTestScheduler(map[string]FakeResult{
+		"a": {Duration: 10 * time.Millisecond},
+	})
+
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": testStage(),
+		"b": testStage("a"),
+		"c": testStage(),
+	}}
+	if err := s.Schedule(p, "user"); err != nil {
+		t.Fatalf("Schedule() = %v", err)
+	}
+
+	checkStatuses(t, store, StatusSuccess, map[string]string{"a": StatusSuccess, "b": StatusSuccess, "c": StatusSuccess})
+
+	// The isolated stage does not wait for the other ones
+	order := startOrder(executor)
+	if order["c"] > order["b"] {
+		t.Errorf("started %v, want c before b", executor.Started())
+	}
+}
+
+func TestScheduleFailureSkipsDependents(t *testing.T) {
+	s, executor, store := newTestScheduler(map[string]FakeResult{
+		"a": {ExitCode: 1, Logs: "boom"},
+	})
+
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": testStage(),
+		"b": testStage("a"),
+		"c": testStage("b"),
+	}}
+	if err := s.Schedule(p, "user"); err == nil {
+		t.Fatal("Schedule() = nil, want an error")
+	}
+
+	checkStatuses(t, store, StatusFailed, map[string]string{"a": StatusFailed, "b": StatusSkipped, "c": StatusSkipped})
+
+	if started := executor.Started(); len(started) != 1 {
+		t.Errorf("started %v, want only p-a", started)
+	}
+	if attempts := store.attempts["a"]; len(attempts) != 1 || attempts[0].Message != "boom" {
+		t.Errorf("attempts of a are %v, want a single one with its logs", attempts)
+	}
+}
+
+func TestScheduleCancel(t *testing.T) {
+	s, executor, store := newTestScheduler(map[string]FakeResult{
+		"a": {Duration: time.Minute},
+	})
+
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": testStage(),
+		"b": testStage("a"),
+	}}
+	result := s.Submit(p, "user")
+
+	for len(executor.Started()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Cancel("p"); err != nil {
+		t.Fatalf("Cancel() = %v", err)
+	}
+
+	select {
+	case <-result:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pipeline did not stop once canceled")
+	}
+
+	checkStatuses(t, store, StatusCanceled, map[string]string{"a": StatusCanceled, "b": StatusCanceled})
+
+	if err := s.Cancel("p"); err != ErrPipelineNotRunning {
+		t.Errorf("Cancel() of a finished pipeline = %v, want %v", err, ErrPipelineNotRunning)
+	}
+}
+
+func TestScheduleTimeout(t *testing.T) {
+	s, _, store := newTestScheduler(map[string]FakeResult{
+		"a": {Duration: time.Minute},
+	})
+
+	a := testStage()
+	a.Timeout = "20ms"
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": a,
+		"b": testStage("a"),
+	}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Schedule(p, "user")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stage did not time out")
+	}
+
+	checkStatuses(t, store, StatusFailed, map[string]string{"a": StatusTimedOut, "b": StatusSkipped})
+}
+
+// Returns the exit code of every attempt of the stages, keyed by stage name,
+// the attempts past the given codes exiting with 0
+func attemptResults(codes map[string][]int64) func(spec ContainerSpec) FakeResult {
+	return func(spec ContainerSpec) FakeResult {
+		attempt := 0
+		for _, env := range spec.Env {
+			if strings.HasPrefix(env, VariableAttempt+"=") {
+				attempt, _ = strconv.Atoi(strings.TrimPrefix(env, VariableAttempt+"="))
+			}
+		}
+
+		stage := strings.TrimPrefix(spec.Name, "p-")
+		if attempt <= len(codes[stage]) {
+			return FakeResult{ExitCode: codes[stage][attempt-1]}
+		}
+
+		return FakeResult{}
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		retry        *RetryMeta
+		codes        []int64
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"succeeds on retry", &RetryMeta{MaxAttempts: 3}, []int64{1, 1}, StatusSuccess, 3},
+		{"out of attempts", &RetryMeta{MaxAttempts: 2}, []int64{1, 1, 1}, StatusFailed, 2},
+		{"exit code not retried", &RetryMeta{MaxAttempts: 3, ExitCodes: ExitCodes{137}}, []int64{1}, StatusFailed, 1},
+		{"exit code retried", &RetryMeta{MaxAttempts: 3, ExitCodes: ExitCodes{137}}, []int64{137}, StatusSuccess, 2},
+		{"no retry policy", nil, []int64{1}, StatusFailed, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, executor, store := newTestScheduler(nil)
+			executor.Run = attemptResults(map[string][]int64{"a": tt.codes})
+
+			a := testStage()
+			a.Retry = tt.retry
+			p := Pipeline{Name: "p", Stages: map[string]StageMeta{"a": a}}
+			s.Schedule(p, "user")
+
+			checkStatuses(t, store, tt.wantStatus, map[string]string{"a": tt.wantStatus})
+
+			if attempts := store.attempts["a"]; len(attempts) != tt.wantAttempts {
+				t.Errorf("a ran %d attempts, want %d", len(attempts), tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestScheduleAllowFailure(t *testing.T) {
+	s, executor, store := newTestScheduler(map[string]FakeResult{
+		"a": {ExitCode: 2},
+	})
+
+	a := testStage()
+	a.AllowFailure = true
+	p := Pipeline{Name: "p", Stages: map[string]StageMeta{
+		"a": a,
+		"b": testStage("a"),
+	}}
+	if err := s.Schedule(p, "user"); err != nil {
+		t.Fatalf("Schedule() = %v", err)
+	}
+
+	checkStatuses(t, store, StatusPassedWithWarnings, map[string]string{"a": StatusFailedAllowed, "b": StatusSuccess})
+
+	if started := executor.Started(); len(started) != 2 {
+		t.Errorf("started %v, want p-a and p-b", started)
+	}
+}
+
+func TestValidateStageNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"build", false},
+		{"unit-tests_2.x", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../../x", true},
+		{"a/b", true},
+		{"with space", true},
+	}
+
+	for _, tt := range tests {
+		p := Pipeline{Name: "p", Stages: map[string]StageMeta{tt.name: testStage()}}
+		if err := p.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() of stage %q = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResumeStoppedPipeline(t *testing.T) {
+	tests := []struct {
+		name       string
+		stopReason string
+		createdAt  time.Time
+		want       string
+	}{
+		{"timing out", StatusTimedOut, time.Now(), StatusTimedOut},
+		{"canceled", StatusCanceled, time.Now(), StatusCanceled},
+		{"timeout exceeded while stopped", "", time.Now().Add(-2 * time.Hour), StatusTimedOut},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, store := newTestScheduler(map[string]FakeResult{"a": {Duration: time.Minute}})
+
+			p := Pipeline{Name: "p", Timeout: "1h", Stages: map[string]StageMeta{
+				"a": testStage(),
+				"b": testStage("a"),
+			}}
+			s.resume(RecoveredPipeline{
+				Pipeline:   p,
+				StartedAt:  &tt.createdAt,
+				CreatedAt:  tt.createdAt,
+				StopReason: tt.stopReason,
+				Stages:     []RecoveredStage{{Name: "a", Status: StatusQueued}},
+			})
+
+			checkStatuses(t, store, tt.want, map[string]string{"b": StatusCanceled})
+		})
+	}
+}
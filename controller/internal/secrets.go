@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Replaces the values of the secrets in the stage logs
+const maskedSecret = "[MASKED]"
+
+// Directory of the Docker containers holding the secrets exposed as files
+const secretsDir = "/run/secrets"
+
+// Length under which a secret would mask common words or numbers of the logs
+const minSecretLength = 8
+
+// A secret of a stage, read from a key of a Vault KV path. It is set in the environment
+// variable named after it, unless "file" is set, in which case it is written to a file
+// and the environment variable holds the path of the file
+type SecretMeta struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+	File bool   `json:"file"`
+}
+
+// Reads the values of the secrets declared by the pipelines. The path is
+// relative to the secrets of the user, so a user cannot read those of another
+type SecretStore interface {
+	Secret(user string, path string, key string) (string, error)
+}
+
+// Checks the secrets declared by a pipeline or a stage
+func validateSecrets(secrets map[string]SecretMeta) error {
+	for name, meta := range secrets {
+		if !variableName.MatchString(name) {
+			return fmt.Errorf("invalid secret name %s", name)
+		}
+
+		if strings.HasPrefix(name, reservedVariablePrefix) {
+			return fmt.Errorf("secret %s uses the reserved prefix %s", name, reservedVariablePrefix)
+		}
+
+		if meta.Path == "" || meta.Key == "" {
+			return fmt.Errorf("secret %s needs a path and a key", name)
+		}
+
+		for _, segment := range strings.Split(meta.Path, "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return fmt.Errorf("invalid path %s for secret %s", meta.Path, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Checks the secrets of a pipeline and its stages, which cannot
+// have the same name as a variable the stage would see as well
+func (p Pipeline) validateSecrets() error {
+	if err := validateSecrets(p.Secrets); err != nil {
+		return err
+	}
+
+	for stage, meta := range p.Stages {
+		if err := validateSecrets(meta.Secrets); err != nil {
+			return fmt.Errorf("invalid stage %s, %v", stage, err)
+		}
+
+		for name := range p.stageSecrets(stage) {
+			_, pipelineVariable := p.Variables[name]
+			_, stageVariable := meta.Variables[name]
+			if pipelineVariable || stageVariable {
+				return fmt.Errorf("invalid stage %s, secret %s has the name of a variable", stage, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the secrets of a stage, which override the ones of the pipeline with the same name
+func (p Pipeline) stageSecrets(stage string) map[string]SecretMeta {
+	secrets := make(map[string]SecretMeta)
+
+	for name, meta := range p.Secrets {
+		secrets[name] = meta
+	}
+	for name, meta := range p.Stages[stage].Secrets {
+		secrets[name] = meta
+	}
+
+	return secrets
+}
+
+// Reads the values of the secrets of a stage, keyed by secret name
+func (s *Scheduler) readSecrets(p Pipeline, stage string) (map[string]string, error) {
+	secrets := p.stageSecrets(stage)
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	if s.secrets == nil {
+		return nil, errors.New("secrets are not available")
+	}
+
+	values := make(map[string]string)
+	for name, meta := range secrets {
+		value, err := s.secrets.Secret(p.UserId, meta.Path, meta.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not read secret %s, %v", name, err)
+		}
+
+		if len(strings.TrimSpace(value)) < minSecretLength {
+			return nil, fmt.Errorf("secret %s is shorter than %d characters", name, minSecretLength)
+		}
+
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// Splits the values of the secrets of a stage between the
+// environment variables and the files of the container
+func (p Pipeline) secretsSpec(stage string, values map[string]string) ([]string, map[string][]byte) {
+	var env []string
+	files := make(map[string][]byte)
+
+	for name, meta := range p.stageSecrets(stage) {
+		if meta.File {
+			files[name] = []byte(values[name])
+		} else {
+			env = append(env, name+"="+values[name])
+		}
+	}
+
+	return env, files
+}
+
+// Replaces the values of the secrets in the logs of a stage. The lines of the
+// multi-line secrets are masked one by one as well, in case they are printed apart,
+// unless they are too short to be told apart from the rest of the logs
+func maskSecrets(message string, values map[string]string) string {
+	var masked []string
+	for _, value := range values {
+		masked = append(masked, value)
+		if strings.Contains(value, "\n") {
+			masked = append(masked, strings.Split(value, "\n")...)
+		}
+	}
+
+	// The longest values first, so that a secret containing another one is fully masked
+	sort.Slice(masked, func(i, j int) bool {
+		return len(masked[i]) > len(masked[j])
+	})
+
+	for _, value := range masked {
+		if len(strings.TrimSpace(value)) >= minSecretLength {
+			message = strings.ReplaceAll(message, value, maskedSecret)
+		}
+	}
+
+	return message
+}
+
+// Creates a tar archive with the secret files of a Docker container,
+// to be extracted at the root of its filesystem
+func secretsArchive(files map[string][]byte) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	dir := strings.TrimPrefix(secretsDir, "/")
+	for _, d := range []string{path.Dir(dir), dir} {
+		err := tw.WriteHeader(&tar.Header{Name: d + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: path.Join(dir, name), Typeflag: tar.TypeReg, Mode: 0444, Size: int64(len(content))})
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
@@ -0,0 +1,76 @@
+package internal
+
+import "testing"
+
+func TestMaskSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		values  map[string]string
+		want    string
+	}{
+		{
+			name:    "every occurrence",
+			message: "token=s3cr3t-token\necho s3cr3t-token",
+			values:  map[string]string{"TOKEN": "s3cr3t-token"},
+			want:    "token=[MASKED]\necho [MASKED]",
+		},
+		{
+			name:    "short values are kept",
+			message: "user=admin",
+			values:  map[string]string{"USER": "admin"},
+			want:    "user=admin",
+		},
+		{
+			name:    "surrounding spaces do not count",
+			message: "value=   abc   ",
+			values:  map[string]string{"VALUE": "   abc   "},
+			want:    "value=   abc   ",
+		},
+		{
+			name:    "secret containing another one",
+			message: "supersecret-longer supersecret",
+			values:  map[string]string{"SHORT": "supersecret", "LONG": "supersecret-longer"},
+			want:    "[MASKED] [MASKED]",
+		},
+		{
+			name:    "lines of a multiline secret",
+			message: "-----BEGIN KEY-----\nprinted line-two-of-the-key",
+			values:  map[string]string{"KEY": "-----BEGIN KEY-----\nline-two-of-the-key"},
+			want:    "[MASKED]\nprinted [MASKED]",
+		},
+		{
+			name:    "no secrets",
+			message: "hello",
+			values:  nil,
+			want:    "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := maskSecrets(tt.message, tt.values); got != tt.want {
+			t.Errorf("%s: maskSecrets() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]SecretMeta
+		wantErr bool
+	}{
+		{"valid", map[string]SecretMeta{"DB_PASSWORD": {Path: "db/prod", Key: "password"}}, false},
+		{"invalid name", map[string]SecretMeta{"db-password": {Path: "db", Key: "password"}}, true},
+		{"reserved prefix", map[string]SecretMeta{"CI_TOKEN": {Path: "ci", Key: "token"}}, true},
+		{"missing key", map[string]SecretMeta{"TOKEN": {Path: "ci"}}, true},
+		{"path escaping the user", map[string]SecretMeta{"TOKEN": {Path: "../other/ci", Key: "token"}}, true},
+		{"empty path segment", map[string]SecretMeta{"TOKEN": {Path: "ci//token", Key: "token"}}, true},
+	}
+
+	for _, tt := range tests {
+		if err := validateSecrets(tt.secrets); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateSecrets() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
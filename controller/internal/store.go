@@ -0,0 +1,363 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Records the progress of the pipelines run by the Scheduler.
+// The controller stores it in the database, while a local run only prints it
+type Store interface {
+	// Stores a new queued pipeline with the edges of its DAG. The pipeline
+	// itself is stored as well, so that it can be resumed after a restart
+	InsertPipeline(p Pipeline, dependencies [][]string)
+
+	// Marks a queued pipeline as running, once its first stages are started
+	StartPipeline(pipelineId string)
+
+	// Counts a resume of an unfinished pipeline after a restart of the controller
+	ResumePipeline(pipelineId string)
+
+	// Stores the status a pipeline is being stopped with, canceled or timed out,
+	// before its running stages are stopped
+	StopPipeline(pipelineId string, status string)
+
+	// Stores the overall status of a finished pipeline
+	FinishPipeline(pipelineId string, status string)
+
+	// Stores a new stage that is either queued or never going to run.
+	// The stages that are never going to run are finished right away
+	InsertStage(pipelineId string, stage string, status string)
+
+	// Marks a queued stage as running once its container started, storing the time
+	// when the container of the first attempt started and the one of the current attempt
+	StartStage(pipelineId string, stage string)
+
+	// Stores the status, the logs and the artifacts of a finished stage,
+	// with the metadata of every artifact
+	FinishStage(pipelineId string, out StageOutput, status string)
+
+	// Stores the logs and the exit code of a single stage attempt
+	InsertAttempt(pipelineId string, out StageOutput)
+
+	// Stores the container created for an attempt of a stage
+	SetStageContainer(pipelineId string, stage string, containerId string, attempt int)
+
+	// Stores the time the next attempt of a stage starts at, once its last attempt failed
+	SetStageRetry(pipelineId string, stage string, nextAttemptAt time.Time)
+
+	// Returns the pipelines that were queued or running when the controller stopped
+	UnfinishedPipelines() []RecoveredPipeline
+
+	// Returns the time a pipeline finished at, nil if it did not finish yet,
+	// and false when the pipeline is not stored
+	FinishedAt(pipelineId string) (*time.Time, bool)
+
+	// Returns the artifacts of a stage that did not expire, so that they can be
+	// passed to the dependent stages
+	Artifacts(pipelineId string, stage string) []Artifact
+
+	// Returns the keys of the artifacts that expired
+	ExpiredArtifacts() []string
+
+	// Deletes the record of an artifact, once it was deleted from the artifact storage
+	DeleteArtifact(key string)
+}
+
+// Store backed by the Postgres database of the controller
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// Creates a store that writes to the given database
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) InsertPipeline(p Pipeline, dependencies [][]string) {
+	priority := p.Priority
+	if priority == "" {
+		priority = PriorityNormal
+	}
+
+	spec, err := json.Marshal(p)
+	if err != nil {
+		log.Fatalf("could not marshal pipeline %s, %v", p.Name, err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO pipelines (id, user_id, dependencies, status, priority, spec) VALUES ($1, $2, $3, $4, $5, $6)",
+		p.Name, p.UserId, pq.Array(dependencies), StatusQueued, priority, spec)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) StartPipeline(pipelineId string) {
+	_, err := s.db.Exec("UPDATE pipelines SET status = $1, started_at = NOW() WHERE id = $2", StatusRunning, pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) ResumePipeline(pipelineId string) {
+	_, err := s.db.Exec("UPDATE pipelines SET resumes = resumes + 1 WHERE id = $1", pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) StopPipeline(pipelineId string, status string) {
+	_, err := s.db.Exec("UPDATE pipelines SET stop_reason = $1 WHERE id = $2", status, pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) FinishPipeline(pipelineId string, status string) {
+	_, err := s.db.Exec("UPDATE pipelines SET status = $1, finished_at = NOW() WHERE id = $2", status, pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) InsertStage(pipelineId string, stage string, status string) {
+	var finishedAt sql.NullTime
+	if status != StatusQueued {
+		finishedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	_, err := s.db.Exec("INSERT INTO stages (pipeline_id, name, status, finished_at) VALUES ($1, $2, $3, $4)",
+		pipelineId, stage, status, finishedAt)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) StartStage(pipelineId string, stage string) {
+	_, err := s.db.Exec("UPDATE stages SET status = $1, started_at = COALESCE(started_at, NOW()), attempt_started_at = NOW() WHERE pipeline_id = $2 AND name = $3",
+		StatusRunning, pipelineId, stage)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) FinishStage(pipelineId string, out StageOutput, status string) {
+	_, err := s.db.Exec("UPDATE stages SET status = $1, message = $2, artifact_urls = $3, attempts = $4, finished_at = NOW() WHERE pipeline_id = $5 AND name = $6",
+		status, out.Message, pq.Array(out.ArtifactUrls), out.Attempt, pipelineId, out.Name)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+
+	for _, a := range out.Artifacts {
+		_, err = s.db.Exec("INSERT INTO artifacts (pipeline_id, stage_name, name, key, location, size, content_type, sha256, archive, mode, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (pipeline_id, stage_name, name) DO NOTHING",
+			pipelineId, out.Name, a.Name, a.Key, a.Location, a.Size, a.ContentType, a.Sha256, a.Archive, a.Mode, a.ExpiresAt)
+		if err != nil {
+			log.Fatalf("Error executing query: %q", err)
+		}
+	}
+}
+
+func (s *PostgresStore) InsertAttempt(pipelineId string, out StageOutput) {
+	_, err := s.db.Exec("INSERT INTO stage_attempts (pipeline_id, stage_name, attempt, exit_code, status, message) VALUES ($1, $2, $3, $4, $5, $6)",
+		pipelineId, out.Name, out.Attempt, out.Status, stageStatus(out), out.Message)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) FinishedAt(pipelineId string) (*time.Time, bool) {
+	var finishedAt sql.NullTime
+	err := s.db.QueryRow("SELECT finished_at FROM pipelines WHERE id = $1", pipelineId).Scan(&finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+
+	if !finishedAt.Valid {
+		return nil, true
+	}
+
+	return &finishedAt.Time, true
+}
+
+func (s *PostgresStore) Artifacts(pipelineId string, stage string) []Artifact {
+	rows, err := s.db.Query("SELECT name, key, location, size, content_type, sha256, archive, COALESCE(mode, 0), expires_at FROM artifacts WHERE pipeline_id = $1 AND stage_name = $2 AND (expires_at IS NULL OR expires_at > NOW()) ORDER BY name",
+		pipelineId, stage)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	var artifacts []Artifact
+
+	for rows.Next() {
+		var a Artifact
+		var expiresAt sql.NullTime
+
+		err = rows.Scan(&a.Name, &a.Key, &a.Location, &a.Size, &a.ContentType, &a.Sha256, &a.Archive, &a.Mode, &expiresAt)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		if expiresAt.Valid {
+			a.ExpiresAt = &expiresAt.Time
+		}
+		artifacts = append(artifacts, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	return artifacts
+}
+
+func (s *PostgresStore) ExpiredArtifacts() []string {
+	rows, err := s.db.Query("SELECT key FROM artifacts WHERE expires_at <= NOW()")
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+
+	for rows.Next() {
+		var key string
+
+		err = rows.Scan(&key)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	return keys
+}
+
+func (s *PostgresStore) DeleteArtifact(key string) {
+	_, err := s.db.Exec("DELETE FROM artifacts WHERE key = $1", key)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) SetStageContainer(pipelineId string, stage string, containerId string, attempt int) {
+	_, err := s.db.Exec("UPDATE stages SET container_id = $1, attempts = $2, attempt_started_at = NULL, next_attempt_at = NULL WHERE pipeline_id = $3 AND name = $4",
+		containerId, attempt, pipelineId, stage)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) SetStageRetry(pipelineId string, stage string, nextAttemptAt time.Time) {
+	_, err := s.db.Exec("UPDATE stages SET next_attempt_at = $1 WHERE pipeline_id = $2 AND name = $3",
+		nextAttemptAt, pipelineId, stage)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+}
+
+func (s *PostgresStore) UnfinishedPipelines() []RecoveredPipeline {
+	rows, err := s.db.Query("SELECT id, user_id, spec, created_at, started_at, resumes, COALESCE(stop_reason, '') FROM pipelines WHERE status IN ($1, $2) ORDER BY created_at",
+		StatusQueued, StatusRunning)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	var pipelines []RecoveredPipeline
+
+	for rows.Next() {
+		var id string
+		var userId string
+		var spec []byte
+		var createdAt time.Time
+		var startedAt sql.NullTime
+		var resumes int
+		var stopReason string
+
+		err = rows.Scan(&id, &userId, &spec, &createdAt, &startedAt, &resumes, &stopReason)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		// The pipelines stored without their spec have no stages and cannot be resumed
+		var p Pipeline
+		if spec != nil {
+			if err := json.Unmarshal(spec, &p); err != nil {
+				log.Printf("could not unmarshal pipeline %s, %v\n", id, err)
+			}
+		}
+		p.Name = id
+		p.UserId = userId
+
+		r := RecoveredPipeline{Pipeline: p, CreatedAt: createdAt, Resumes: resumes, StopReason: stopReason}
+		if startedAt.Valid {
+			r.StartedAt = &startedAt.Time
+		}
+
+		pipelines = append(pipelines, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	for i := range pipelines {
+		pipelines[i].Stages = s.recoveredStages(pipelines[i].Pipeline.Name)
+	}
+
+	return pipelines
+}
+
+// Gets the stored stages of a pipeline that did not finish
+func (s *PostgresStore) recoveredStages(pipelineId string) []RecoveredStage {
+	rows, err := s.db.Query("SELECT name, status, COALESCE(container_id, ''), COALESCE(attempts, 0), attempt_started_at, next_attempt_at FROM stages WHERE pipeline_id = $1 ORDER BY created_at", pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	var stages []RecoveredStage
+
+	for rows.Next() {
+		var r RecoveredStage
+		var attemptStartedAt sql.NullTime
+		var nextAttemptAt sql.NullTime
+
+		err = rows.Scan(&r.Name, &r.Status, &r.ContainerId, &r.Attempt, &attemptStartedAt, &nextAttemptAt)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		if attemptStartedAt.Valid {
+			r.AttemptStartedAt = &attemptStartedAt.Time
+		}
+		if nextAttemptAt.Valid {
+			r.NextAttemptAt = &nextAttemptAt.Time
+		}
+
+		stages = append(stages, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	return stages
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Built-in variables set in the environment of every stage
+const (
+	VariablePipelineId = "CI_PIPELINE_ID"
+	VariableStageName  = "CI_STAGE_NAME"
+	VariableUserId     = "CI_USER_ID"
+	VariableAttempt    = "CI_ATTEMPT"
+)
+
+// The prefix of the built-in variables, which the pipelines cannot declare
+const reservedVariablePrefix = "CI_"
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Checks the names of the variables declared by a pipeline or a stage
+func validateVariables(variables map[string]string) error {
+	for name := range variables {
+		if !variableName.MatchString(name) {
+			return fmt.Errorf("invalid variable name %s", name)
+		}
+
+		if strings.HasPrefix(name, reservedVariablePrefix) {
+			return fmt.Errorf("variable %s uses the reserved prefix %s", name, reservedVariablePrefix)
+		}
+	}
+
+	return nil
+}
+
+// Checks the variables of a pipeline and its stages, and that every parameter
+// overrides a variable declared by the pipeline or by one of its stages
+func (p Pipeline) validateVariables() error {
+	if err := validateVariables(p.Variables); err != nil {
+		return err
+	}
+
+	for stage, meta := range p.Stages {
+		if err := validateVariables(meta.Variables); err != nil {
+			return fmt.Errorf("invalid stage %s, %v", stage, err)
+		}
+	}
+
+	for name := range p.Params {
+		if !p.declares(name) {
+			return fmt.Errorf("parameter %s is not declared in the variables of the pipeline", name)
+		}
+	}
+
+	return nil
+}
+
+// Tells if a variable is declared by the pipeline or by one of its stages
+func (p Pipeline) declares(name string) bool {
+	if _, ok := p.Variables[name]; ok {
+		return true
+	}
+
+	for _, meta := range p.Stages {
+		if _, ok := meta.Variables[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the environment of an attempt of a stage, as KEY=value pairs sorted by key.
+// The stage variables override the ones of the pipeline, the parameters override
+// the variables the stage sees, and the built-in variables cannot be overridden
+func (p Pipeline) stageEnv(stage string, attempt int) []string {
+	variables := make(map[string]string)
+
+	for name, value := range p.Variables {
+		variables[name] = value
+	}
+	for name, value := range p.Stages[stage].Variables {
+		variables[name] = value
+	}
+	for name, value := range p.Params {
+		if _, ok := variables[name]; ok {
+			variables[name] = value
+		}
+	}
+
+	variables[VariablePipelineId] = p.Name
+	variables[VariableStageName] = stage
+	variables[VariableUserId] = p.UserId
+	variables[VariableAttempt] = strconv.Itoa(attempt)
+
+	env := make([]string, 0, len(variables))
+	for name, value := range variables {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return env
+}
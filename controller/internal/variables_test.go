@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"GOFLAGS", false},
+		{"_private", false},
+		{"build_2", false},
+		{"2FAST", true},
+		{"MY-VAR", true},
+		{"", true},
+		{"CI_COMMIT", true},
+	}
+
+	for _, tt := range tests {
+		err := validateVariables(map[string]string{tt.name: "value"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateVariables(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStageEnv(t *testing.T) {
+	p := Pipeline{
+		Name:      "p",
+		UserId:    "user",
+		Variables: map[string]string{"GOOS": "linux", "MODE": "debug", "LEVEL": "1"},
+		Params:    map[string]string{"MODE": "release", "TARGET": "arm"},
+		Stages: map[string]StageMeta{
+			"build": {Variables: map[string]string{"LEVEL": "2", "TARGET": "amd64"}},
+			"test":  {},
+		},
+	}
+
+	tests := []struct {
+		stage string
+		want  []string
+	}{
+		{
+			// The stage overrides the pipeline and the parameters override both
+			stage: "build",
+			want: []string{"CI_ATTEMPT=2", "CI_PIPELINE_ID=p", "CI_STAGE_NAME=build", "CI_USER_ID=user",
+				"GOOS=linux", "LEVEL=2", "MODE=release", "TARGET=arm"},
+		},
+		{
+			// A parameter is only set for the stages that see its variable
+			stage: "test",
+			want: []string{"CI_ATTEMPT=2", "CI_PIPELINE_ID=p", "CI_STAGE_NAME=test", "CI_USER_ID=user",
+				"GOOS=linux", "LEVEL=1", "MODE=release"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := p.stageEnv(tt.stage, 2)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("stageEnv(%s) = %v, want %v", tt.stage, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineValidateVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Pipeline
+		wantErr bool
+	}{
+		{
+			name: "parameter of a stage variable",
+			p:    Pipeline{Params: map[string]string{"TARGET": "arm"}, Stages: map[string]StageMeta{"a": {Variables: map[string]string{"TARGET": "amd64"}}}},
+		},
+		{
+			name:    "undeclared parameter",
+			p:       Pipeline{Params: map[string]string{"TARGET": "arm"}, Stages: map[string]StageMeta{"a": {}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid stage variable",
+			p:       Pipeline{Stages: map[string]StageMeta{"a": {Variables: map[string]string{"CI_STAGE_NAME": "x"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		if err := tt.p.validateVariables(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateVariables() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,56 +2,354 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 )
 
-func GetAWSCreds() (string, string, string) {
-	config := vault.DefaultConfig()
-	config.Address = "http://vault:8200"
+// Address of the Vault of the stack, used when VAULT_ADDR is not set
+const defaultVaultAddress = "http://vault:8200"
 
-	client, err := vault.NewClient(config)
+// How long the secrets read from Vault are cached, when VAULT_CACHE_TTL is not set
+const defaultVaultCacheTTL = time.Minute
+
+// Returned by VaultConfigFromEnv when the environment has no Vault credentials
+var ErrVaultNotConfigured = errors.New("no Vault credentials, set either VAULT_ROLE_ID, VAULT_TOKEN or VAULT_TOKEN_FILE")
+
+// Configuration of the Vault client. The controller logs in with AppRole when
+// RoleId is set, and with a token otherwise, the token file being read again
+// on every login so that it can be rotated, e.g. by a Vault agent
+type VaultConfig struct {
+	Address string
+
+	Token     string
+	TokenFile string
+
+	RoleId       string
+	SecretId     string
+	SecretIdFile string
+
+	// Mount path of the AppRole auth method, "approle" when empty
+	AppRoleMount string
+
+	// How long the secrets are cached, 0 meaning they are read from Vault every time
+	CacheTTL time.Duration
+}
+
+// Reads the configuration of the Vault client from the environment:
+// VAULT_ADDR, VAULT_TOKEN, VAULT_TOKEN_FILE, VAULT_ROLE_ID, VAULT_SECRET_ID,
+// VAULT_SECRET_ID_FILE, VAULT_APPROLE_MOUNT and VAULT_CACHE_TTL (e.g. "30s").
+// ErrVaultNotConfigured is returned when none of the credentials is set
+func VaultConfigFromEnv() (VaultConfig, error) {
+	config := VaultConfig{
+		Address:      os.Getenv("VAULT_ADDR"),
+		Token:        os.Getenv("VAULT_TOKEN"),
+		TokenFile:    os.Getenv("VAULT_TOKEN_FILE"),
+		RoleId:       os.Getenv("VAULT_ROLE_ID"),
+		SecretId:     os.Getenv("VAULT_SECRET_ID"),
+		SecretIdFile: os.Getenv("VAULT_SECRET_ID_FILE"),
+		AppRoleMount: os.Getenv("VAULT_APPROLE_MOUNT"),
+		CacheTTL:     defaultVaultCacheTTL,
+	}
+
+	if config.Address == "" {
+		config.Address = defaultVaultAddress
+	}
+
+	if ttl := os.Getenv("VAULT_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			return config, fmt.Errorf("invalid VAULT_CACHE_TTL %s", ttl)
+		}
+		config.CacheTTL = d
+	}
+
+	if config.RoleId == "" && config.Token == "" && config.TokenFile == "" {
+		return config, ErrVaultNotConfigured
+	}
+
+	return config, nil
+}
+
+// A secret read from Vault and the time it expires from the cache at
+type cachedSecret struct {
+	data      map[string]interface{}
+	expiresAt time.Time
+}
+
+// Client of Vault shared by the controller. It logs in on the first read,
+// renews its token in the background while it can, and logs in again once
+// the token expired. The secrets read with ReadKV are cached for the configured TTL
+type VaultClient struct {
+	config VaultConfig
+	client *vault.Client
+
+	// Set while the client holds a valid token. The token of the client
+	// is only changed with mu locked, and only read with mu read locked
+	mu       sync.RWMutex
+	loggedIn bool
+
+	cacheMu sync.Mutex
+	cache   map[string]cachedSecret
+}
+
+// Creates a Vault client, which only logs in when it first reads a secret
+func NewVaultClient(config VaultConfig) (*VaultClient, error) {
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = config.Address
+
+	client, err := vault.NewClient(vaultConfig)
 	if err != nil {
-		log.Fatalf("Unable to initialize a Vault client: %v", err)
+		return nil, err
 	}
 
-	client.SetToken("hvs.LmVCy2Qd3wUxMsD6IBzByCFQ")
+	// The token comes from the configuration only, not from the VAULT_TOKEN picked by NewClient
+	client.ClearToken()
 
-	secret, err := client.KVv2("kv").Get(context.Background(), "aws/credentials")
+	return &VaultClient{
+		config: config,
+		client: client,
+		cache:  make(map[string]cachedSecret),
+	}, nil
+}
+
+// Logs in, unless the client already holds a valid token
+func (c *VaultClient) login() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loggedIn {
+		return nil
+	}
+
+	var auth *vault.Secret
+	var err error
+	if c.config.RoleId != "" {
+		auth, err = c.loginAppRole()
+	} else {
+		auth, err = c.loginToken()
+	}
 	if err != nil {
-		log.Fatalf(
-			"Unable to read the super secret password from the vault: %v",
-			err,
-		)
+		return err
 	}
 
-	accessKey, ok := secret.Data["AWS_ACCESS_KEY_ID"].(string)
-	if !ok {
-		log.Fatalf(
-			"value type assertion failed: %T %#v",
-			secret.Data["AWS_ACCESS_KEY_ID"],
-			secret.Data["AWS_ACCESS_KEY_ID"],
-		)
+	c.loggedIn = true
+
+	if auth != nil && auth.Auth != nil && auth.Auth.Renewable {
+		go c.renew(auth)
 	}
 
-	secretKey, ok := secret.Data["AWS_SECRET_ACCESS_KEY"].(string)
-	if !ok {
-		log.Fatalf(
-			"value type assertion failed: %T %#v",
-			secret.Data["AWS_SECRET_ACCESS_KEY"],
-			secret.Data["AWS_SECRET_ACCESS_KEY"],
-		)
+	return nil
+}
+
+// Logs in with the AppRole auth method and returns the new token
+func (c *VaultClient) loginAppRole() (*vault.Secret, error) {
+	secretId := c.config.SecretId
+	if c.config.SecretIdFile != "" {
+		data, err := os.ReadFile(c.config.SecretIdFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the AppRole secret id, %v", err)
+		}
+		secretId = strings.TrimSpace(string(data))
+	}
+
+	mount := c.config.AppRoleMount
+	if mount == "" {
+		mount = "approle"
+	}
+
+	c.client.ClearToken()
+	auth, err := c.client.Logical().Write("auth/"+mount+"/login", map[string]interface{}{
+		"role_id":   c.config.RoleId,
+		"secret_id": secretId,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not log in with AppRole, %v", err)
+	}
+	if auth == nil || auth.Auth == nil {
+		return nil, errors.New("could not log in with AppRole, no token returned")
+	}
+
+	c.client.SetToken(auth.Auth.ClientToken)
+	return auth, nil
+}
+
+// Uses the configured token, returning it as a renewable secret when it can be renewed
+func (c *VaultClient) loginToken() (*vault.Secret, error) {
+	token := c.config.Token
+	if c.config.TokenFile != "" {
+		data, err := os.ReadFile(c.config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Vault token, %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	c.client.SetToken(token)
+
+	self, err := c.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, fmt.Errorf("could not look the Vault token up, %v", err)
+	}
+
+	renewable, err := self.TokenIsRenewable()
+	if err != nil || !renewable {
+		return nil, err
+	}
+
+	return c.client.Auth().Token().RenewSelf(0)
+}
+
+// Renews the token until it cannot be renewed anymore, after which
+// the next read logs in again
+func (c *VaultClient) renew(auth *vault.Secret) {
+	watcher, err := c.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: auth})
+	if err != nil {
+		log.Printf("could not renew the Vault token, %v\n", err)
+		return
+	}
+
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Printf("could not renew the Vault token, %v\n", err)
+			}
+			c.logout(auth.Auth.ClientToken)
+			return
+
+		case <-watcher.RenewCh():
+			log.Println("renewed the Vault token")
+		}
+	}
+}
+
+// Forgets the token, so that the next read logs in again. Nothing
+// is done when the client already logged in with another token
+func (c *VaultClient) logout(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client.Token() == token {
+		c.loggedIn = false
+	}
+}
+
+// Reads a secret of the kv mount, from the cache when it was read less than
+// the cache TTL ago. The expired secrets are dropped from the cache while
+// a new one is added. A missing secret returns vault.ErrSecretNotFound
+func (c *VaultClient) ReadKV(path string) (map[string]interface{}, error) {
+	c.cacheMu.Lock()
+	cached, ok := c.cache[path]
+	c.cacheMu.Unlock()
+
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.data, nil
+	}
+
+	data, err := c.readKV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.CacheTTL > 0 {
+		now := time.Now()
+
+		c.cacheMu.Lock()
+		for p, cached := range c.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(c.cache, p)
+			}
+		}
+		c.cache[path] = cachedSecret{data: data, expiresAt: now.Add(c.config.CacheTTL)}
+		c.cacheMu.Unlock()
+	}
+
+	return data, nil
+}
+
+// Reads a secret from Vault, logging in again once when the token was revoked or expired
+func (c *VaultClient) readKV(path string) (map[string]interface{}, error) {
+	for retry := 0; ; retry++ {
+		if err := c.login(); err != nil {
+			return nil, err
+		}
+
+		// A login or a renewal may not change the token during the request
+		c.mu.RLock()
+		token := c.client.Token()
+		secret, err := c.client.KVv2("kv").Get(context.Background(), path)
+		c.mu.RUnlock()
+
+		var respErr *vault.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden && retry == 0 {
+			c.logout(token)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return secret.Data, nil
+	}
+}
+
+// Reads the AWS credentials of the artifact storage, at kv/aws/credentials
+func (c *VaultClient) GetAWSCreds() (string, string, string, error) {
+	data, err := c.ReadKV("aws/credentials")
+	if err != nil {
+		return "", "", "", fmt.Errorf("could not read the AWS credentials from Vault, %v", err)
+	}
+
+	var values []string
+	for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION"} {
+		value, ok := data[key].(string)
+		if !ok {
+			return "", "", "", fmt.Errorf("the AWS credentials of Vault have no %s", key)
+		}
+		values = append(values, value)
+	}
+
+	return values[0], values[1], values[2], nil
+}
+
+// Reads the secrets of the pipelines from Vault. The paths of the secrets are relative
+// to kv/pipelines/<user>, so the pipelines cannot read the secrets of the controller
+// nor the ones of the other users. They are not cached, so that every attempt
+// of a stage reads the current value of its secrets
+type VaultSecretStore struct {
+	vault *VaultClient
+}
+
+// Creates a store of the pipeline secrets backed by the given Vault client
+func NewVaultSecretStore(vault *VaultClient) *VaultSecretStore {
+	return &VaultSecretStore{vault: vault}
+}
+
+func (s *VaultSecretStore) Secret(user string, path string, key string) (string, error) {
+	if user == "" {
+		return "", errors.New("the pipeline has no user to read the secrets of")
+	}
+
+	data, err := s.vault.readKV("pipelines/" + user + "/" + path)
+	if err != nil {
+		return "", err
 	}
 
-	region, ok := secret.Data["AWS_REGION"].(string)
+	value, ok := data[key].(string)
 	if !ok {
-		log.Fatalf(
-			"value type assertion failed: %T %#v",
-			secret.Data["AWS_REGION"],
-			secret.Data["AWS_REGION"],
-		)
+		return "", fmt.Errorf("secret %s has no key %s", path, key)
 	}
 
-	return accessKey, secretKey, region
+	return value, nil
 }
@@ -1,30 +1,48 @@
 package main
 
 import (
+	"context"
 	"controller/internal"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	"github.com/gorilla/schema"
 	"github.com/lib/pq"
 )
 
 var (
-	redisClient *redis.Client
-	scheduler   *internal.Scheduler
-	dbClient    *sql.DB
+	redisClient   *redis.Client
+	scheduler     *internal.Scheduler
+	dbClient      *sql.DB
+	artifactStore internal.ArtifactStore
 )
 
 type PipelineRecord struct {
 	Id           string
 	UserId       string
 	Dependencies [][]string
+	Status       string
+	Priority     string
+	CreatedAt    *time.Time
+	StartedAt    *time.Time
+	FinishedAt   *time.Time
+	Duration     string
 }
 
 type StageRecord struct {
@@ -33,6 +51,35 @@ type StageRecord struct {
 	Messages     []string
 	Status       string
 	ArtifactUrls []string
+	Attempts     []AttemptRecord
+
+	// Position in the queue of the container slots, 0 when the stage is not queued
+	QueuePosition int
+
+	CreatedAt  *time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Duration   string
+}
+
+type AttemptRecord struct {
+	Attempt  int
+	ExitCode int64
+	Status   string
+	Messages []string
+}
+
+type ArtifactRecord struct {
+	Name        string
+	Size        int64
+	ContentType string
+	Sha256      string
+
+	// Set when the artifact is a directory, downloaded as a tar archive
+	Archive bool
+
+	CreatedAt *time.Time
+	ExpiresAt *time.Time
 }
 
 type StageSubrecord struct {
@@ -41,6 +88,30 @@ type StageSubrecord struct {
 	Status     string
 }
 
+// Converts a nullable timestamp column to a pointer, so it is omitted as null in JSON
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
+
+// Computes the duration between the start and the end of a pipeline or stage.
+// The duration of a pipeline or stage that is still running is computed up to now
+func duration(startedAt sql.NullTime, finishedAt sql.NullTime) string {
+	if !startedAt.Valid {
+		return ""
+	}
+
+	end := time.Now()
+	if finishedAt.Valid {
+		end = finishedAt.Time
+	}
+
+	return end.Sub(startedAt.Time).Round(time.Second).String()
+}
+
 func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "*")
@@ -81,7 +152,48 @@ func handleExecute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go scheduler.Schedule(p, ip)
+	if err := scheduler.Validate(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The pipeline id is generated here, so it can be returned
+	// to the client and later used to query or cancel the pipeline
+	p.Name = uuid.New().String()
+	scheduler.Submit(p, ip)
+
+	response, err := json.Marshal(map[string]string{"id": p.Name})
+	if err != nil {
+		log.Fatalf("could not marshal pipeline id, %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Cancels a running pipeline that belongs to the user
+func handleCancel(w http.ResponseWriter, ip string, id string) {
+	if id == "" {
+		http.Error(w, "missing pipeline id", http.StatusBadRequest)
+		return
+	}
+
+	var userId string
+	err := dbClient.QueryRow("SELECT user_id FROM pipelines WHERE id = $1", id).Scan(&userId)
+	if err == sql.ErrNoRows || (err == nil && userId != ip) {
+		http.Error(w, "pipeline not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+
+	err = scheduler.Cancel(id)
+	if errors.Is(err, internal.ErrPipelineNotRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func handleStages(w http.ResponseWriter, r *http.Request) {
@@ -160,8 +272,29 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 
 	id := strings.TrimPrefix(r.URL.Path, "/pipelines/")
 
+	// The artifacts of a stage are under /pipelines/{id}/stages/{stage}/artifacts[/{path}]
+	if parts := strings.SplitN(id, "/", 5); len(parts) > 1 {
+		if len(parts) < 4 || parts[1] != "stages" || parts[3] != "artifacts" {
+			http.NotFound(w, r)
+			return
+		}
+
+		artifactPath := ""
+		if len(parts) == 5 {
+			artifactPath = parts[4]
+		}
+
+		handleArtifacts(w, r, ip, parts[0], parts[2], artifactPath)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		handleCancel(w, ip, id)
+		return
+	}
+
 	if id == "" {
-		rows, err := dbClient.Query("SELECT id, user_id, to_json(dependencies) FROM pipelines WHERE user_id = $1", ip)
+		rows, err := dbClient.Query("SELECT id, user_id, to_json(dependencies), COALESCE(status, ''), COALESCE(priority, ''), created_at, started_at, finished_at FROM pipelines WHERE user_id = $1 ORDER BY created_at", ip)
 		if err != nil {
 			log.Fatalf("Error executing query: %q", err)
 		}
@@ -173,8 +306,11 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 			var id string
 			var userId string
 			var deps []byte
+			var status string
+			var priority string
+			var createdAt, startedAt, finishedAt sql.NullTime
 
-			err = rows.Scan(&id, &userId, &deps)
+			err = rows.Scan(&id, &userId, &deps, &status, &priority, &createdAt, &startedAt, &finishedAt)
 			if err != nil {
 				log.Fatalf("Error scanning rows: %q", err)
 			}
@@ -187,6 +323,12 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 				Id:           id,
 				UserId:       userId,
 				Dependencies: biArray,
+				Status:       status,
+				Priority:     priority,
+				CreatedAt:    nullTime(createdAt),
+				StartedAt:    nullTime(startedAt),
+				FinishedAt:   nullTime(finishedAt),
+				Duration:     duration(startedAt, finishedAt),
 			}
 
 			pipelineRecords = append(pipelineRecords, r)
@@ -206,7 +348,7 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 
 		// Get all stages for a pipeline id
 	} else {
-		rows, err := dbClient.Query("SELECT s.pipeline_id, s.name, s.message, s.status, s.artifact_urls FROM stages s INNER JOIN pipelines p ON p.id = s.pipeline_id WHERE p.user_id = $1 AND p.id = $2", ip, id)
+		rows, err := dbClient.Query("SELECT s.pipeline_id, s.name, COALESCE(s.message, ''), s.status, s.artifact_urls, s.created_at, s.started_at, s.finished_at FROM stages s INNER JOIN pipelines p ON p.id = s.pipeline_id WHERE p.user_id = $1 AND p.id = $2 ORDER BY s.created_at", ip, id)
 		if err != nil {
 			log.Fatalf("Error executing query: %q", err)
 		}
@@ -220,20 +362,13 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 			var message string
 			var status string
 			var artifactUrls pq.StringArray
+			var createdAt, startedAt, finishedAt sql.NullTime
 
-			err = rows.Scan(&pipelineId, &name, &message, &status, &artifactUrls)
+			err = rows.Scan(&pipelineId, &name, &message, &status, &artifactUrls, &createdAt, &startedAt, &finishedAt)
 			if err != nil {
 				log.Fatalf("Error scanning rows: %q", err)
 			}
 
-			// Filter evil urls?
-			urls := []string(artifactUrls)
-			for i, u := range urls {
-				if len(u) < 80 {
-					urls = append(urls[:i], urls[i+1:]...)
-				}
-			}
-
 			messages := strings.Split(strings.Trim(message, "\n"), "\n")
 
 			r := StageRecord{
@@ -241,7 +376,11 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 				Name:         name,
 				Messages:     messages,
 				Status:       status,
-				ArtifactUrls: urls,
+				ArtifactUrls: artifactUrls,
+				CreatedAt:    nullTime(createdAt),
+				StartedAt:    nullTime(startedAt),
+				FinishedAt:   nullTime(finishedAt),
+				Duration:     duration(startedAt, finishedAt),
 			}
 
 			stageRecords = append(stageRecords, r)
@@ -252,6 +391,14 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 			log.Fatalf("Error: %q", err)
 		}
 
+		attempts := queryAttempts(id)
+		for i := range stageRecords {
+			stageRecords[i].Attempts = attempts[stageRecords[i].Name]
+			if stageRecords[i].Status == internal.StatusQueued {
+				stageRecords[i].QueuePosition = scheduler.QueuePosition(id, stageRecords[i].Name)
+			}
+		}
+
 		response, err := json.Marshal(stageRecords)
 		if err != nil {
 			log.Fatalf("could not marshal list of records, %v", err)
@@ -261,16 +408,296 @@ func handlePipelines(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Lists the artifacts of a stage of a pipeline that belongs to the user,
+// or streams one of them from the artifact store when a path is given
+func handleArtifacts(w http.ResponseWriter, r *http.Request, ip string, id string, stage string, artifactPath string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var userId string
+	err := dbClient.QueryRow("SELECT user_id FROM pipelines WHERE id = $1", id).Scan(&userId)
+	if err == sql.ErrNoRows || (err == nil && userId != ip) {
+		http.Error(w, "pipeline not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+
+	if artifactPath == "" {
+		response, err := json.Marshal(queryArtifacts(id, stage))
+		if err != nil {
+			log.Fatalf("could not marshal list of artifacts, %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+		return
+	}
+
+	// The artifacts are named after their cleaned path in the working directory of the stage
+	name := path.Clean("/" + artifactPath)[1:]
+
+	var key, contentType, sha string
+	var size int64
+	err = dbClient.QueryRow("SELECT key, content_type, size, sha256 FROM artifacts WHERE pipeline_id = $1 AND stage_name = $2 AND name = $3 AND (expires_at IS NULL OR expires_at > NOW())",
+		id, stage, name).Scan(&key, &contentType, &size, &sha)
+	if err == sql.ErrNoRows {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+
+	if artifactStore == nil {
+		http.Error(w, "artifacts are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	content, err := artifactStore.Get(r.Context(), key)
+	if err != nil {
+		log.Printf("could not read artifact %s, %v\n", key, err)
+		http.Error(w, "could not read artifact", http.StatusBadGateway)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}))
+	w.Header().Set("X-Artifact-Sha256", sha)
+
+	_, err = io.Copy(w, content)
+	if err != nil {
+		log.Printf("could not send artifact %s, %v\n", key, err)
+	}
+}
+
+// Gets the artifacts of a stage that did not expire yet
+func queryArtifacts(pipelineId string, stage string) []ArtifactRecord {
+	rows, err := dbClient.Query("SELECT name, size, content_type, sha256, archive, created_at, expires_at FROM artifacts WHERE pipeline_id = $1 AND stage_name = $2 AND (expires_at IS NULL OR expires_at > NOW()) ORDER BY name", pipelineId, stage)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	var artifacts []ArtifactRecord
+
+	for rows.Next() {
+		var a ArtifactRecord
+		var createdAt, expiresAt sql.NullTime
+
+		err = rows.Scan(&a.Name, &a.Size, &a.ContentType, &a.Sha256, &a.Archive, &createdAt, &expiresAt)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		a.CreatedAt = nullTime(createdAt)
+		a.ExpiresAt = nullTime(expiresAt)
+		artifacts = append(artifacts, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	return artifacts
+}
+
+// Gets the attempt history of every stage of a pipeline, keyed by stage name
+func queryAttempts(pipelineId string) map[string][]AttemptRecord {
+	rows, err := dbClient.Query("SELECT stage_name, attempt, exit_code, status, message FROM stage_attempts WHERE pipeline_id = $1 ORDER BY attempt", pipelineId)
+	if err != nil {
+		log.Fatalf("Error executing query: %q", err)
+	}
+	defer rows.Close()
+
+	attempts := make(map[string][]AttemptRecord)
+
+	for rows.Next() {
+		var stage string
+		var a AttemptRecord
+		var message string
+
+		err = rows.Scan(&stage, &a.Attempt, &a.ExitCode, &a.Status, &message)
+		if err != nil {
+			log.Fatalf("Error scanning rows: %q", err)
+		}
+
+		a.Messages = strings.Split(strings.Trim(message, "\n"), "\n")
+		attempts[stage] = append(attempts[stage], a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Fatalf("Error: %q", err)
+	}
+
+	return attempts
+}
+
+// Lists the schema migrations. They are only applied when the controller
+// starts or by client db migrate, so that nobody can change the schema through the API
+func handleMigrations(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	migrations, err := internal.MigrationStatus(dbClient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(migrations)
+	if err != nil {
+		log.Fatalf("could not marshal list of migrations, %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
 func main() {
+	enabledExecutors := flag.String("executors", "docker", "comma separated executors the pipelines can use (docker, shell). "+
+		"The shell executor runs the stage scripts directly on the controller host")
+	defaultExecutor := flag.String("executor", "docker", "executor used by the pipelines that do not set one")
+	maxContainers := flag.Int("max-containers", 20, "maximum number of stage containers running at the same time, across all the pipelines")
+	maxContainersPerUser := flag.Int("max-containers-per-user", 0, "maximum number of stage containers of a single user running at the same time, 0 meaning no limit")
+	shellDir := flag.String("shell-dir", filepath.Join(os.TempDir(), "big-data-ci"), "directory holding the working directories of the shell executor")
+	instance := flag.String("instance", "big-data-ci", "name of the controller, set as a label on its containers so that the controllers sharing a Docker daemon only remove their own. "+
+		"It must stay the same across restarts, for the controller to find the containers of its pipelines again, and differ between the controllers sharing a Docker daemon")
+	containerRetention := flag.Duration("container-retention", 0, "how long the containers of a finished pipeline are kept for inspection, 0 removing them as soon as the pipeline finishes")
+	registryAuthFile := flag.String("registry-auth", "", "JSON file with the credentials of the private registries, keyed by registry, e.g. "+
+		`{"localhost:5000": {"username": "ci", "password": "secret"}}`)
+	registryAuthVault := flag.Bool("registry-auth-vault", false, "look the credentials of the private registries up in Vault, at kv/registries/<registry>, "+
+		"after the ones of -registry-auth")
+	artifactStoreName := flag.String("artifact-store", "s3", "storage of the stage artifacts: s3 (any S3 compatible storage, e.g. MinIO), local (a directory of the controller host) or none")
+	artifactDir := flag.String("artifact-dir", filepath.Join(os.TempDir(), "big-data-ci-artifacts"), "directory holding the artifacts with the local artifact store")
+	s3Bucket := flag.String("s3-bucket", "big-data-artifacts", "bucket holding the artifacts with the s3 artifact store")
+	s3Endpoint := flag.String("s3-endpoint", "", "endpoint of the S3 compatible storage, e.g. http://minio:9000 (default is AWS S3)")
+	s3PathStyle := flag.Bool("s3-path-style", false, "address the bucket in the path instead of the host name, as MinIO expects")
+	s3Region := flag.String("s3-region", "", "region of the S3 storage (default is the region stored in Vault)")
+	s3Credentials := flag.String("s3-credentials", "vault", "source of the S3 credentials: vault (kv/aws/credentials) or env (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, ...)")
+	flag.Parse()
+
 	redisClient = internal.InitRedisClient()
 	dbClient = internal.InitDBConn()
-	scheduler = internal.NewScheduler(20, dbClient)
+
+	migrations, err := internal.Migrate(dbClient)
+	if err != nil {
+		log.Fatalf("could not migrate the database, %v", err)
+	}
+	log.Printf("applied %d migrations\n", len(migrations))
+
+	// Vault is only needed for the pipeline secrets unless the registry or the S3
+	// credentials are read from it, so that the controller also runs offline
+	needsVault := *registryAuthVault || (*artifactStoreName == "s3" && *s3Credentials == "vault")
+
+	var vaultClient *internal.VaultClient
+	vaultConfig, err := internal.VaultConfigFromEnv()
+	switch {
+	case err == nil:
+		vaultClient, err = internal.NewVaultClient(vaultConfig)
+		if err != nil {
+			log.Fatalf("Unable to initialize a Vault client: %v", err)
+		}
+	case errors.Is(err, internal.ErrVaultNotConfigured) && !needsVault:
+		log.Printf("%v, the secrets of the pipelines are not available\n", err)
+	default:
+		log.Fatalf("Unable to configure the Vault client: %v", err)
+	}
+
+	var registryAuth internal.RegistryAuthChain
+	if *registryAuthFile != "" {
+		auth, err := internal.LoadRegistryAuth(*registryAuthFile)
+		if err != nil {
+			log.Fatalf("could not load the registry credentials, %v", err)
+		}
+		registryAuth = append(registryAuth, auth)
+	}
+	if *registryAuthVault {
+		registryAuth = append(registryAuth, internal.NewVaultRegistryAuth(vaultClient))
+	}
+
+	executors := make(map[string]internal.Executor)
+	for _, name := range strings.Split(*enabledExecutors, ",") {
+		switch name {
+		case "docker":
+			var docker *internal.DockerExecutor
+			docker, err = internal.NewDockerExecutor()
+			if err == nil && len(registryAuth) > 0 {
+				docker.SetRegistryAuth(registryAuth)
+			}
+			executors[name] = docker
+		case "shell":
+			executors[name], err = internal.NewShellExecutor(*shellDir)
+		default:
+			err = fmt.Errorf("unknown executor %s", name)
+		}
+
+		if err != nil {
+			log.Fatalf("could not create the %s executor, %v", name, err)
+		}
+	}
+
+	scheduler = internal.NewScheduler(*maxContainers, internal.NewPostgresStore(dbClient), executors, *defaultExecutor)
+	scheduler.SetMaxContainersPerUser(*maxContainersPerUser)
+	scheduler.SetInstance(*instance)
+	scheduler.SetContainerRetention(*containerRetention)
+	if vaultClient != nil {
+		scheduler.SetSecretStore(internal.NewVaultSecretStore(vaultClient))
+	}
+
+	switch *artifactStoreName {
+	case "s3":
+		config := internal.S3Config{
+			Bucket:    *s3Bucket,
+			Endpoint:  *s3Endpoint,
+			PathStyle: *s3PathStyle,
+			Region:    *s3Region,
+		}
+
+		switch *s3Credentials {
+		case "vault":
+			config.Credentials = vaultClient.GetAWSCreds
+		case "env":
+		default:
+			log.Fatalf("unknown source of the S3 credentials %s", *s3Credentials)
+		}
+
+		artifactStore = internal.NewS3ArtifactStore(config)
+	case "local":
+		artifactStore, err = internal.NewLocalArtifactStore(*artifactDir)
+		if err != nil {
+			log.Fatalf("could not create the local artifact store, %v", err)
+		}
+	case "none":
+	default:
+		log.Fatalf("unknown artifact store %s", *artifactStoreName)
+	}
+
+	if artifactStore != nil {
+		scheduler.SetArtifactStore(artifactStore)
+	}
+
+	// Resume the pipelines that were running when the controller stopped
+	scheduler.Recover()
+
+	// Remove the containers of the finished pipelines, and the ones left by the pipelines that are not stored
+	scheduler.StartReaper(context.Background(), time.Minute)
 
 	http.HandleFunc("/execute", handleExecute)
 	http.HandleFunc("/pipelines/", handlePipelines)
 	http.HandleFunc("/stages", handleStages)
+	http.HandleFunc("/migrations", handleMigrations)
 
-	err := http.ListenAndServe(":8081", nil)
+	err = http.ListenAndServe(":8081", nil)
 	if err != nil {
 		log.Fatalf("could not listen, %v", err)
 	}
@@ -0,0 +1,297 @@
+// Runs pipelines in-process with the same scheduler as the controller,
+// without the database, Redis, Vault and the artifact storage
+package runner
+
+import (
+	"context"
+	"controller/internal"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The pipeline schema accepted by the controller
+type Pipeline = internal.Pipeline
+
+// Statuses of a pipeline that finished without failures
+const (
+	StatusSuccess            = internal.StatusSuccess
+	StatusPassedWithWarnings = internal.StatusPassedWithWarnings
+)
+
+// Configurations of a local run:
+// * Executor is the name of the executor running the stages (docker, shell),
+// the one of the pipeline or docker being used when empty.
+// * ShellDir holds the working directories of the shell executor.
+// * Out receives the stage events, their logs and the final summary.
+type Options struct {
+	Executor string
+	ShellDir string
+	Out      io.Writer
+}
+
+// Creates the executor with the given name
+func newExecutor(name string, shellDir string) (internal.Executor, error) {
+	switch name {
+	case "docker":
+		return internal.NewDockerExecutor()
+	case "shell":
+		if shellDir == "" {
+			shellDir = filepath.Join(os.TempDir(), "big-data-ci")
+		}
+		return internal.NewShellExecutor(shellDir)
+	default:
+		return nil, fmt.Errorf("unknown executor %s", name)
+	}
+}
+
+// Runs a pipeline until it finishes or ctx is canceled, printing the progress of the
+// stages as it goes, and returns the status of the pipeline. The artifacts are not
+// uploaded, they are only copied to the stages that depend on them
+func Run(ctx context.Context, p Pipeline, opts Options) (string, error) {
+	name := opts.Executor
+	if name == "" {
+		name = p.Executor
+	}
+	if name == "" {
+		name = "docker"
+	}
+	p.Executor = name
+
+	executor, err := newExecutor(name, opts.ShellDir)
+	if err != nil {
+		return "", err
+	}
+
+	out := opts.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	store := newLocalStore(out)
+	s := internal.NewScheduler(len(p.Stages)+1, store, map[string]internal.Executor{name: executor}, name)
+	s.SetInstance("local")
+
+	// The logs are printed as the stages write them when the executor can follow them
+	s.SetLogSink(store.printLine)
+
+	if err := s.Validate(p); err != nil {
+		return "", err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// The id keeps the container names of concurrent local runs apart
+	p.Name = "local-" + strings.Split(uuid.New().String(), "-")[0]
+
+	// The pipeline can be canceled as soon as it is submitted, so an interrupt is never lost
+	result := s.Submit(p, "local")
+	select {
+	case <-result:
+	case <-ctx.Done():
+		fmt.Fprintf(out, "==> canceling pipeline %s\n", p.Name)
+		if err := s.Cancel(p.Name); err != nil && !errors.Is(err, internal.ErrPipelineNotRunning) {
+			fmt.Fprintf(out, "==> could not cancel pipeline %s, %v\n", p.Name, err)
+		}
+		<-result
+	}
+
+	store.printSummary()
+	return store.status, nil
+}
+
+// The outcome of a stage of a local run
+type stageResult struct {
+	status     string
+	attempts   int
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+// Store that prints the progress of a local run instead of persisting it
+type localStore struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	// Number of lines of the running attempt of each stage printed while it ran
+	streamed map[string]int
+
+	status     string
+	startedAt  time.Time
+	finishedAt time.Time
+
+	// Stages in the order they were scheduled
+	order  []string
+	stages map[string]*stageResult
+}
+
+func newLocalStore(out io.Writer) *localStore {
+	return &localStore{
+		out:      out,
+		stages:   make(map[string]*stageResult),
+		streamed: make(map[string]int),
+	}
+}
+
+func (s *localStore) InsertPipeline(p Pipeline, dependencies [][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = internal.StatusQueued
+	fmt.Fprintf(s.out, "==> running pipeline %s\n", p.Name)
+}
+
+func (s *localStore) StartPipeline(pipelineId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = internal.StatusRunning
+	s.startedAt = time.Now()
+}
+
+func (s *localStore) ResumePipeline(pipelineId string) {
+}
+
+func (s *localStore) StopPipeline(pipelineId string, status string) {
+}
+
+func (s *localStore) FinishPipeline(pipelineId string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = status
+	s.finishedAt = time.Now()
+}
+
+func (s *localStore) InsertStage(pipelineId string, stage string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &stageResult{status: status}
+	if status != internal.StatusQueued {
+		r.finishedAt = time.Now()
+		fmt.Fprintf(s.out, "==> stage %s %s\n", stage, status)
+	}
+
+	s.order = append(s.order, stage)
+	s.stages[stage] = r
+}
+
+func (s *localStore) StartStage(pipelineId string, stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.stages[stage]
+	r.status = internal.StatusRunning
+	if r.startedAt.IsZero() {
+		r.startedAt = time.Now()
+	}
+
+	fmt.Fprintf(s.out, "==> stage %s started (attempt %d)\n", stage, r.attempts+1)
+}
+
+func (s *localStore) FinishStage(pipelineId string, out internal.StageOutput, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.stages[out.Name]
+	r.status = status
+	r.finishedAt = time.Now()
+
+	fmt.Fprintf(s.out, "==> stage %s %s\n", out.Name, status)
+}
+
+// Prints a line of the logs of a stage while it runs
+func (s *localStore) printLine(pipelineId string, stage string, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.out, "[%s] %s\n", stage, line)
+	s.streamed[stage]++
+}
+
+// Prints the logs of every attempt that were not printed while the stage ran,
+// e.g. all of them when the executor cannot follow them, or the errors of the attempt
+func (s *localStore) InsertAttempt(pipelineId string, out internal.StageOutput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages[out.Name].attempts = out.Attempt
+
+	streamed := s.streamed[out.Name]
+	delete(s.streamed, out.Name)
+
+	for i, line := range strings.Split(strings.TrimSuffix(out.Message, "\n"), "\n") {
+		if i >= streamed && line != "" {
+			fmt.Fprintf(s.out, "[%s] %s\n", out.Name, line)
+		}
+	}
+
+	if out.Err == nil {
+		fmt.Fprintf(s.out, "==> stage %s exited with code %d (attempt %d)\n", out.Name, out.Status, out.Attempt)
+	}
+}
+
+func (s *localStore) SetStageContainer(pipelineId string, stage string, containerId string, attempt int) {
+}
+
+func (s *localStore) SetStageRetry(pipelineId string, stage string, nextAttemptAt time.Time) {
+}
+
+// A local run is not resumed, it is canceled when the client stops
+func (s *localStore) UnfinishedPipelines() []internal.RecoveredPipeline {
+	return nil
+}
+
+func (s *localStore) FinishedAt(pipelineId string) (*time.Time, bool) {
+	return nil, false
+}
+
+// A local run does not upload artifacts, they are copied from the containers of the dependencies
+func (s *localStore) Artifacts(pipelineId string, stage string) []internal.Artifact {
+	return nil
+}
+
+func (s *localStore) ExpiredArtifacts() []string {
+	return nil
+}
+
+func (s *localStore) DeleteArtifact(key string) {
+}
+
+// Prints a table with the status, the attempts and the duration of every stage
+func (s *localStore) printSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintln(s.out)
+
+	w := tabwriter.NewWriter(s.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tSTATUS\tATTEMPTS\tDURATION")
+	for _, stage := range s.order {
+		r := s.stages[stage]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", stage, r.status, r.attempts, elapsed(r.startedAt, r.finishedAt))
+	}
+	w.Flush()
+
+	fmt.Fprintf(s.out, "\npipeline %s in %s\n", s.status, elapsed(s.startedAt, s.finishedAt))
+}
+
+// Formats the time between the start and the end of a pipeline or stage
+func elapsed(startedAt time.Time, finishedAt time.Time) string {
+	if startedAt.IsZero() || finishedAt.IsZero() {
+		return ""
+	}
+
+	return finishedAt.Sub(startedAt).Round(time.Millisecond).String()
+}
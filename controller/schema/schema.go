@@ -0,0 +1,22 @@
+// Applies the schema migrations of the controller database from outside of
+// the controller, with the same migrations and the same advisory lock
+package schema
+
+import (
+	"controller/internal"
+	"database/sql"
+)
+
+// A schema migration, with the time it was applied at
+type Migration = internal.Migration
+
+// Applies the pending migrations and returns the migrations that were applied.
+// The migrations of the controllers starting meanwhile wait for these ones
+func Migrate(db *sql.DB) ([]Migration, error) {
+	return internal.Migrate(db)
+}
+
+// Lists all the migrations with the time they were applied at
+func Status(db *sql.DB) ([]Migration, error) {
+	return internal.MigrationStatus(db)
+}